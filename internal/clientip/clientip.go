@@ -0,0 +1,108 @@
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ctxKey struct{}
+
+// ParseTrusted parses a comma-separated list of IPs and CIDRs.
+func ParseTrusted(list string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: item}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+// Middleware resolves the client address once per request and stores it in
+// the request context. X-Forwarded-For and X-Real-IP are only honored when the
+// direct peer is one of the trusted proxies.
+func Middleware(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolve(r, trusted)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, ip)))
+		})
+	}
+}
+
+// FromRequest returns the address resolved by Middleware, falling back to the
+// direct peer.
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(ctxKey{}).(string); ok && ip != "" {
+		return ip
+	}
+	return peer(r)
+}
+
+func resolve(r *http.Request, trusted []*net.IPNet) string {
+	addr := peer(r)
+	if !isTrusted(addr, trusted) {
+		return addr
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		// Walk right to left: the first hop we do not trust is the client.
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			addr = hop
+			if !isTrusted(hop, trusted) {
+				return hop
+			}
+		}
+		return addr
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return addr
+}
+
+func peer(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrusted(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "10.0.0.1", want: []string{"10.0.0.1/32"}},
+		{list: " 10.0.0.0/8 , ,::1", want: []string{"10.0.0.0/8", "::1/128"}},
+		{list: "172.16.0.0/12,fd00::/8", want: []string{"172.16.0.0/12", "fd00::/8"}},
+		{list: "10.0.0.256", wantErr: true},
+		{list: "proxy.local", wantErr: true},
+		{list: "10.0.0.0/33", wantErr: true},
+		{list: "10.0.0.1,nope", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTrusted(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTrusted(%q) err = %v, wantErr %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseTrusted(%q) = %v, want %v", tt.list, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Errorf("ParseTrusted(%q)[%d] = %v, want %s", tt.list, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+	}{
+		{name: "direct peer", remoteAddr: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "forwarded header from an untrusted peer is ignored", remoteAddr: "203.0.113.7:4000", xff: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "real IP from an untrusted peer is ignored", remoteAddr: "203.0.113.7:4000", realIP: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.5:4000", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted IPv6 proxy", remoteAddr: "[::1]:4000", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed leftmost hop", remoteAddr: "10.0.0.5:4000", xff: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.5:4000", xff: []string{"198.51.100.1, 10.0.0.9"}, want: "198.51.100.1"},
+		{name: "repeated headers", remoteAddr: "10.0.0.5:4000", xff: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "only trusted hops", remoteAddr: "10.0.0.5:4000", xff: []string{"10.0.0.8, 10.0.0.9"}, want: "10.0.0.8"},
+		{name: "garbage hop stops the walk", remoteAddr: "10.0.0.5:4000", xff: []string{"198.51.100.1, junk"}, want: "10.0.0.5"},
+		{name: "real IP from a trusted proxy", remoteAddr: "10.0.0.5:4000", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "invalid real IP", remoteAddr: "10.0.0.5:4000", realIP: "junk", want: "10.0.0.5"},
+		{name: "peer without a port", remoteAddr: "203.0.113.7", want: "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		var got string
+		Middleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = FromRequest(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("%s: client IP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromRequestWithoutMiddleware(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := FromRequest(r); got != "203.0.113.7" {
+		t.Fatalf("client IP = %q, want the direct peer", got)
+	}
+}
@@ -0,0 +1,305 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/homenavi/spotify-integration/internal/clientip"
+)
+
+const (
+	// Header is the request header carrying the client's idempotency key.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set to "true" on responses replayed from the store.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+	// maxFingerprintBytes bounds how much of a request body is hashed; the
+	// API rejects larger bodies anyway.
+	maxFingerprintBytes = 64 << 10
+)
+
+type Config struct {
+	// TTL is how long a response is kept for replay.
+	TTL time.Duration
+	// MaxKeys caps the number of stored responses; the oldest is dropped
+	// when the cap is reached.
+	MaxKeys int
+	// Identity returns a stable caller identity (e.g. a verified JWT
+	// subject). When it returns "", the client IP is used instead. Keys are
+	// only matched within one caller.
+	Identity func(*http.Request) string
+}
+
+type entry struct {
+	fingerprint [32]byte
+	// done is closed once the first request finished; stored is then set
+	// if its response may be replayed.
+	done    chan struct{}
+	stored  *response
+	expires time.Time
+}
+
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// New returns middleware that makes POST, PUT, PATCH and DELETE requests
+// carrying an Idempotency-Key header execute at most once per key. A
+// duplicate gets the stored response replayed; one arriving while the first
+// is still running waits for it. Responses that invite a retry (429 and
+// 5xx) are not stored, so the next attempt runs again.
+func New(cfg Config) func(http.Handler) http.Handler {
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Hour
+	}
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = 1000
+	}
+
+	var (
+		mu      sync.Mutex
+		entries = map[string]*entry{}
+	)
+
+	sweep := func(now time.Time) {
+		for key, e := range entries {
+			if e.stored != nil && now.After(e.expires) {
+				delete(entries, key)
+			}
+		}
+	}
+
+	evictOldest := func() {
+		var (
+			oldestKey string
+			oldest    time.Time
+		)
+		for key, e := range entries {
+			if e.stored == nil {
+				continue
+			}
+			if oldestKey == "" || e.expires.Before(oldest) {
+				oldestKey, oldest = key, e.expires
+			}
+		}
+		if oldestKey != "" {
+			delete(entries, oldestKey)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idemKey := r.Header.Get(Header)
+			if idemKey == "" || !isMutating(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !validKey(idemKey) {
+				writeError(w, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key must be 1-255 printable ASCII characters")
+				return
+			}
+			fingerprint, err := fingerprintRequest(r)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body")
+				return
+			}
+
+			caller := ""
+			if cfg.Identity != nil {
+				if id := cfg.Identity(r); id != "" {
+					caller = "sub:" + id
+				}
+			}
+			if caller == "" {
+				caller = "ip:" + clientip.FromRequest(r)
+			}
+			key := caller + "|" + idemKey
+
+			for {
+				now := time.Now()
+				mu.Lock()
+				e, ok := entries[key]
+				if ok && e.stored != nil && now.After(e.expires) {
+					delete(entries, key)
+					ok = false
+				}
+				if !ok {
+					if len(entries) >= cfg.MaxKeys {
+						sweep(now)
+						if len(entries) >= cfg.MaxKeys {
+							evictOldest()
+						}
+					}
+					e = &entry{fingerprint: fingerprint, done: make(chan struct{})}
+					entries[key] = e
+					mu.Unlock()
+					execute(w, r, next, func(stored *response) {
+						mu.Lock()
+						defer mu.Unlock()
+						if stored == nil {
+							delete(entries, key)
+						} else {
+							e.stored = stored
+							e.expires = time.Now().Add(cfg.TTL)
+						}
+						close(e.done)
+					})
+					return
+				}
+				mu.Unlock()
+
+				if e.fingerprint != fingerprint {
+					writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used for a different request")
+					return
+				}
+				select {
+				case <-e.done:
+				case <-r.Context().Done():
+					writeError(w, http.StatusConflict, "idempotency_key_in_use", "a request with this Idempotency-Key is still running")
+					return
+				}
+				mu.Lock()
+				stored := e.stored
+				mu.Unlock()
+				if stored == nil {
+					// The first attempt was not stored; run this one.
+					continue
+				}
+				slog.DebugContext(r.Context(), "replaying idempotent response", "method", r.Method, "path", r.URL.Path, "status", stored.status)
+				replay(w, stored)
+				return
+			}
+		})
+	}
+}
+
+// execute runs the first request for a key and hands its response to
+// finish, or nil when the response must not be replayed.
+func execute(w http.ResponseWriter, r *http.Request, next http.Handler, finish func(*response)) {
+	rec := &recorder{ResponseWriter: w, before: w.Header().Clone()}
+	completed := false
+	defer func() {
+		if completed && rec.status == 0 {
+			// Nothing was written; net/http answers 200 with no body.
+			rec.status, rec.header = http.StatusOK, http.Header{}
+		}
+		if completed && replayable(rec.status) {
+			finish(&response{status: rec.status, header: rec.header, body: rec.body.Bytes()})
+			return
+		}
+		finish(nil)
+	}()
+	next.ServeHTTP(rec, r)
+	completed = true
+}
+
+func replay(w http.ResponseWriter, stored *response) {
+	h := w.Header()
+	for name, values := range stored.header {
+		// Headers set by outer middleware (request id, rate limit) describe
+		// this request, not the original one.
+		if _, ok := h[name]; ok {
+			continue
+		}
+		h[name] = append([]string(nil), values...)
+	}
+	h.Set(ReplayedHeader, "true")
+	w.WriteHeader(stored.status)
+	_, _ = w.Write(stored.body)
+}
+
+// recorder passes the response through while keeping a copy of it and of
+// the headers the wrapped handler added.
+type recorder struct {
+	http.ResponseWriter
+	before http.Header
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = http.Header{}
+		for name, values := range r.ResponseWriter.Header() {
+			if _, ok := r.before[name]; !ok {
+				r.header[name] = append([]string(nil), values...)
+			}
+		}
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// fingerprintRequest hashes the method, path, query and body, so a key
+// reused for a different request is detected. The body is restored for the
+// handler.
+func fingerprintRequest(r *http.Request) ([32]byte, error) {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n")
+	if r.Body != nil && r.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(r.Body, maxFingerprintBytes))
+		if err != nil {
+			return [32]byte{}, err
+		}
+		h.Write(buf)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func replayable(status int) bool {
+	return status < 500 && status != http.StatusTooManyRequests
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": message, "code": code, "status": status})
+}
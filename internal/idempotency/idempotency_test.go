@@ -0,0 +1,296 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler answers every call with the next value of its counter, so
+// a replay is told apart from a second run by the body.
+type countingHandler struct {
+	calls  atomic.Int32
+	status func(call int32) int
+	// gate, when set, blocks every call until it is closed.
+	gate chan struct{}
+	// started receives a value whenever a call begins.
+	started chan struct{}
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := h.calls.Add(1)
+	if h.started != nil {
+		h.started <- struct{}{}
+	}
+	if h.gate != nil {
+		<-h.gate
+	}
+	status := http.StatusCreated
+	if h.status != nil {
+		status = h.status(n)
+	}
+	w.Header().Set("X-Call", fmt.Sprint(n))
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"call":%d}`, n)
+}
+
+func newTestMiddleware(cfg Config, h http.Handler) http.Handler {
+	if cfg.Identity == nil {
+		cfg.Identity = func(r *http.Request) string { return r.Header.Get("X-User") }
+	}
+	return New(cfg)(h)
+}
+
+func do(h http.Handler, method, key, body string) *httptest.ResponseRecorder {
+	return doContext(context.Background(), h, method, key, body)
+}
+
+func doContext(ctx context.Context, h http.Handler, method, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/play", strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("X-User", "alice")
+	if key != "" {
+		r.Header.Set(Header, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode error body %q: %v", w.Body.String(), err)
+	}
+	return body.Code
+}
+
+func TestReplaysStoredResponse(t *testing.T) {
+	h := &countingHandler{}
+	mw := newTestMiddleware(Config{}, h)
+
+	first := do(mw, http.MethodPost, "k1", `{"uri":"a"}`)
+	second := do(mw, http.MethodPost, "k1", `{"uri":"a"}`)
+
+	if n := h.calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times, want 1", n)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay = %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("replay is missing %s", ReplayedHeader)
+	}
+	if first.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("first response is marked as replayed")
+	}
+	if second.Header().Get("X-Call") != "1" {
+		t.Errorf("replayed X-Call = %q, want the original header", second.Header().Get("X-Call"))
+	}
+}
+
+func TestPassesThroughWithoutKeyOrForReads(t *testing.T) {
+	h := &countingHandler{}
+	mw := newTestMiddleware(Config{}, h)
+
+	do(mw, http.MethodPost, "", `{}`)
+	do(mw, http.MethodPost, "", `{}`)
+	do(mw, http.MethodGet, "k1", "")
+	do(mw, http.MethodGet, "k1", "")
+	if n := h.calls.Load(); n != 4 {
+		t.Fatalf("handler ran %d times, want 4", n)
+	}
+}
+
+func TestRejectsInvalidKey(t *testing.T) {
+	mw := newTestMiddleware(Config{}, &countingHandler{})
+	for _, key := range []string{"has space", strings.Repeat("k", maxKeyLength+1)} {
+		w := do(mw, http.MethodPost, key, `{}`)
+		if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_idempotency_key" {
+			t.Errorf("key %.20q: %d %s, want 400 invalid_idempotency_key", key, w.Code, w.Body)
+		}
+	}
+}
+
+func TestFingerprintMismatch(t *testing.T) {
+	h := &countingHandler{}
+	mw := newTestMiddleware(Config{}, h)
+
+	do(mw, http.MethodPost, "k1", `{"uri":"a"}`)
+	for name, req := range map[string]struct{ method, body string }{
+		"body":   {http.MethodPost, `{"uri":"b"}`},
+		"method": {http.MethodPut, `{"uri":"a"}`},
+	} {
+		w := do(mw, req.method, "k1", req.body)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want 422", name, w.Code)
+			continue
+		}
+		if code := errorCode(t, w); code != "idempotency_key_reused" {
+			t.Errorf("%s: code = %q, want idempotency_key_reused", name, code)
+		}
+	}
+	if n := h.calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times, want 1", n)
+	}
+}
+
+func TestKeysAreScopedToCaller(t *testing.T) {
+	h := &countingHandler{}
+	mw := newTestMiddleware(Config{}, h)
+
+	do(mw, http.MethodPost, "k1", `{}`)
+	r := httptest.NewRequest(http.MethodPost, "/api/play", strings.NewReader(`{}`))
+	r.Header.Set("X-User", "bob")
+	r.Header.Set(Header, "k1")
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, r)
+
+	if n := h.calls.Load(); n != 2 {
+		t.Fatalf("handler ran %d times, want once per caller", n)
+	}
+	if w.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("another caller got a replay")
+	}
+}
+
+func TestConcurrentDuplicateWaitsForFirst(t *testing.T) {
+	h := &countingHandler{gate: make(chan struct{}), started: make(chan struct{}, 2)}
+	mw := newTestMiddleware(Config{}, h)
+
+	var wg sync.WaitGroup
+	var first, second *httptest.ResponseRecorder
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		first = do(mw, http.MethodPost, "k1", `{}`)
+	}()
+	<-h.started
+
+	secondDone := make(chan struct{})
+	go func() {
+		defer close(secondDone)
+		second = do(mw, http.MethodPost, "k1", `{}`)
+	}()
+	select {
+	case <-secondDone:
+		t.Fatal("duplicate returned while the first request was still running")
+	case <-h.started:
+		t.Fatal("duplicate ran the handler while the first request was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(h.gate)
+	wg.Wait()
+	<-secondDone
+	if n := h.calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times, want 1", n)
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get(ReplayedHeader) != "true" {
+		t.Fatalf("duplicate = %d %q, want a replay of %q", second.Code, second.Body, first.Body)
+	}
+}
+
+func TestConcurrentDuplicateGivesUp(t *testing.T) {
+	h := &countingHandler{gate: make(chan struct{}), started: make(chan struct{}, 1)}
+	mw := newTestMiddleware(Config{}, h)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do(mw, http.MethodPost, "k1", `{}`)
+	}()
+	<-h.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := doContext(ctx, mw, http.MethodPost, "k1", `{}`)
+	if w.Code != http.StatusConflict || errorCode(t, w) != "idempotency_key_in_use" {
+		t.Fatalf("duplicate = %d %s, want 409 idempotency_key_in_use", w.Code, w.Body)
+	}
+	close(h.gate)
+	<-done
+}
+
+func TestRetryableResponsesAreNotStored(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		h := &countingHandler{status: func(call int32) int {
+			if call == 1 {
+				return status
+			}
+			return http.StatusOK
+		}}
+		mw := newTestMiddleware(Config{}, h)
+
+		first := do(mw, http.MethodPost, "k1", `{}`)
+		second := do(mw, http.MethodPost, "k1", `{}`)
+		third := do(mw, http.MethodPost, "k1", `{}`)
+
+		if first.Code != status {
+			t.Fatalf("first status = %d, want %d", first.Code, status)
+		}
+		if second.Code != http.StatusOK || second.Header().Get(ReplayedHeader) != "" {
+			t.Errorf("after a %d the retry = %d replayed=%q, want a fresh 200", status, second.Code, second.Header().Get(ReplayedHeader))
+		}
+		if third.Header().Get(ReplayedHeader) != "true" || third.Body.String() != second.Body.String() {
+			t.Errorf("after a %d the successful retry was not stored", status)
+		}
+		if n := h.calls.Load(); n != 2 {
+			t.Errorf("after a %d the handler ran %d times, want 2", status, n)
+		}
+	}
+}
+
+func TestClientErrorsAreStored(t *testing.T) {
+	h := &countingHandler{status: func(int32) int { return http.StatusBadRequest }}
+	mw := newTestMiddleware(Config{}, h)
+
+	do(mw, http.MethodPost, "k1", `{}`)
+	w := do(mw, http.MethodPost, "k1", `{}`)
+	if w.Code != http.StatusBadRequest || w.Header().Get(ReplayedHeader) != "true" {
+		t.Fatalf("second = %d replayed=%q, want the stored 400", w.Code, w.Header().Get(ReplayedHeader))
+	}
+}
+
+func TestMaxKeysEvictsOldest(t *testing.T) {
+	h := &countingHandler{}
+	mw := newTestMiddleware(Config{MaxKeys: 2}, h)
+
+	for _, key := range []string{"a", "b", "c"} {
+		do(mw, http.MethodPost, key, `{}`)
+		// Distinct expiry times, so "oldest" is well defined.
+		time.Sleep(2 * time.Millisecond)
+	}
+	if w := do(mw, http.MethodPost, "c", `{}`); w.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("newest key was not replayed")
+	}
+	if w := do(mw, http.MethodPost, "a", `{}`); w.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("oldest key was replayed, want it evicted")
+	}
+	if n := h.calls.Load(); n != 4 {
+		t.Fatalf("handler ran %d times, want 4", n)
+	}
+}
+
+func TestExpiredResponsesRunAgain(t *testing.T) {
+	h := &countingHandler{}
+	mw := newTestMiddleware(Config{TTL: 10 * time.Millisecond}, h)
+
+	do(mw, http.MethodPost, "k1", `{}`)
+	time.Sleep(20 * time.Millisecond)
+	if w := do(mw, http.MethodPost, "k1", `{}`); w.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("expired response was replayed")
+	}
+	if n := h.calls.Load(); n != 2 {
+		t.Fatalf("handler ran %d times, want 2", n)
+	}
+}
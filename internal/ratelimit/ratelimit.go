@@ -1,10 +1,16 @@
 package ratelimit
 
 import (
-	"net"
+	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/homenavi/spotify-integration/internal/clientip"
 )
 
 type bucket struct {
@@ -12,52 +18,185 @@ type bucket struct {
 	tokens float64
 }
 
+// Limit is a token bucket: rps tokens/sec, up to burst tokens.
+type Limit struct {
+	RPS   float64
+	Burst float64
+}
+
+// Route overrides the default limit for requests whose path starts with
+// Prefix. The longest matching prefix wins.
+type Route struct {
+	Prefix string
+	Limit
+}
+
+type Config struct {
+	Default Limit
+	Routes  []Route
+	// IdleTTL is how long an untouched bucket is kept. A bucket idle for
+	// longer than burst/rps is full again, so evicting it loses nothing.
+	IdleTTL time.Duration
+	// MaxKeys caps the number of live buckets; the least recently used
+	// bucket is dropped when the cap is reached.
+	MaxKeys int
+	// Identity returns a stable caller identity (e.g. a verified JWT
+	// subject). When it returns "", the client IP is used instead.
+	Identity func(*http.Request) string
+}
+
 // NewIPRateLimiter returns a very small, dependency-free limiter.
 // rps: tokens/sec, burst: max tokens.
 func NewIPRateLimiter(rps float64, burst float64) func(http.Handler) http.Handler {
-	if rps <= 0 {
-		rps = 5
+	return New(Config{Default: Limit{RPS: rps, Burst: burst}})
+}
+
+// New returns a limiter keyed by caller identity (or client IP) and route.
+func New(cfg Config) func(http.Handler) http.Handler {
+	cfg.Default = cfg.Default.withDefaults(Limit{RPS: 5, Burst: 10})
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = 10 * time.Minute
 	}
-	if burst <= 0 {
-		burst = 10
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = 10000
 	}
+	routes := append([]Route(nil), cfg.Routes...)
+	for i := range routes {
+		routes[i].Limit = routes[i].Limit.withDefaults(cfg.Default)
+	}
+	sort.SliceStable(routes, func(a, b int) bool { return len(routes[a].Prefix) > len(routes[b].Prefix) })
 
 	var (
-		mu      sync.Mutex
-		buckets = map[string]*bucket{}
+		mu        sync.Mutex
+		buckets   = map[string]*bucket{}
+		lastSweep = time.Now()
 	)
 
+	sweep := func(now time.Time) {
+		for key, b := range buckets {
+			if now.Sub(b.last) > cfg.IdleTTL {
+				delete(buckets, key)
+			}
+		}
+		lastSweep = now
+	}
+
+	evictOldest := func() {
+		var (
+			oldestKey string
+			oldest    time.Time
+		)
+		for key, b := range buckets {
+			if oldestKey == "" || b.last.Before(oldest) {
+				oldestKey, oldest = key, b.last
+			}
+		}
+		delete(buckets, oldestKey)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			host, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				host = r.RemoteAddr
+			limit, scope := cfg.Default, "*"
+			for _, route := range routes {
+				if strings.HasPrefix(r.URL.Path, route.Prefix) {
+					limit, scope = route.Limit, route.Prefix
+					break
+				}
+			}
+			caller := ""
+			if cfg.Identity != nil {
+				if id := cfg.Identity(r); id != "" {
+					caller = "sub:" + id
+				}
 			}
+			if caller == "" {
+				caller = "ip:" + clientip.FromRequest(r)
+			}
+			key := caller + "|" + scope
 
+			now := time.Now()
 			mu.Lock()
-			b, ok := buckets[host]
+			if now.Sub(lastSweep) > cfg.IdleTTL/2 {
+				sweep(now)
+			}
+			b, ok := buckets[key]
 			if !ok {
-				b = &bucket{last: time.Now(), tokens: burst}
-				buckets[host] = b
+				if len(buckets) >= cfg.MaxKeys {
+					sweep(now)
+					if len(buckets) >= cfg.MaxKeys {
+						evictOldest()
+					}
+				}
+				b = &bucket{last: now, tokens: limit.Burst}
+				buckets[key] = b
 			}
 
-			now := time.Now()
 			dt := now.Sub(b.last).Seconds()
 			b.last = now
-			b.tokens += dt * rps
-			if b.tokens > burst {
-				b.tokens = burst
+			b.tokens += dt * limit.RPS
+			if b.tokens > limit.Burst {
+				b.tokens = limit.Burst
 			}
-			if b.tokens < 1 {
-				mu.Unlock()
+			allowed := b.tokens >= 1
+			if allowed {
+				b.tokens -= 1
+			}
+			tokens := b.tokens
+			mu.Unlock()
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(int(limit.Burst)))
+			h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(tokens)))))
+			h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((limit.Burst-tokens)/limit.RPS))))
+			if !allowed {
+				h.Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil((1-tokens)/limit.RPS)))))
+				h.Set("Content-Type", "application/json; charset=utf-8")
 				w.WriteHeader(http.StatusTooManyRequests)
-				_, _ = w.Write([]byte("rate limited"))
+				_, _ = w.Write([]byte(`{"error":"rate limited","code":"rate_limited","status":429}` + "\n"))
 				return
 			}
-			b.tokens -= 1
-			mu.Unlock()
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+func (l Limit) withDefaults(fallback Limit) Limit {
+	if l.RPS <= 0 {
+		l.RPS = fallback.RPS
+	}
+	if l.Burst <= 0 {
+		l.Burst = fallback.Burst
+	}
+	return l
+}
+
+// ParseRoutes parses "prefix=rps:burst" entries separated by commas, e.g.
+// "/api/volume=2:5,/api/state=20:40".
+func ParseRoutes(spec string) ([]Route, error) {
+	var out []Route
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, rate, ok := strings.Cut(item, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route limit %q", item)
+		}
+		rpsStr, burstStr, _ := strings.Cut(rate, ":")
+		rps, err := strconv.ParseFloat(strings.TrimSpace(rpsStr), 64)
+		if err != nil || rps <= 0 {
+			return nil, fmt.Errorf("invalid rps in %q", item)
+		}
+		burst := rps * 2
+		if strings.TrimSpace(burstStr) != "" {
+			burst, err = strconv.ParseFloat(strings.TrimSpace(burstStr), 64)
+			if err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst in %q", item)
+			}
+		}
+		out = append(out, Route{Prefix: strings.TrimSpace(prefix), Limit: Limit{RPS: rps, Burst: burst}})
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []Route
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "/api/volume=2:4", want: []Route{{Prefix: "/api/volume", Limit: Limit{RPS: 2, Burst: 4}}}},
+		{spec: " /api/volume = 2 : 4 , ,/api/seek=0.5", want: []Route{
+			{Prefix: "/api/volume", Limit: Limit{RPS: 2, Burst: 4}},
+			{Prefix: "/api/seek", Limit: Limit{RPS: 0.5, Burst: 1}},
+		}},
+		{spec: "/api/state=20:", want: []Route{{Prefix: "/api/state", Limit: Limit{RPS: 20, Burst: 40}}}},
+		{spec: "api/volume=2:4", wantErr: true},
+		{spec: "/api/volume", wantErr: true},
+		{spec: "/api/volume=fast", wantErr: true},
+		{spec: "/api/volume=0:4", wantErr: true},
+		{spec: "/api/volume=-1:4", wantErr: true},
+		{spec: "/api/volume=2:0.5", wantErr: true},
+		{spec: "/api/volume=2:many", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoutes(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRoutes(%q) err = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseRoutes(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseRoutes(%q)[%d] = %+v, want %+v", tt.spec, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		// first and second are the requests sent one after the other to a
+		// limiter with a burst of one.
+		first, second func() *http.Request
+		// limited is whether the second request must be refused.
+		limited bool
+	}{
+		{
+			name:    "same client and route",
+			first:   func() *http.Request { return request("/api/state", "10.0.0.1:1000", "") },
+			second:  func() *http.Request { return request("/api/state", "10.0.0.1:2000", "") },
+			limited: true,
+		},
+		{
+			name:   "different clients",
+			first:  func() *http.Request { return request("/api/state", "10.0.0.1:1000", "") },
+			second: func() *http.Request { return request("/api/state", "10.0.0.2:1000", "") },
+		},
+		{
+			name:   "same client on another route",
+			first:  func() *http.Request { return request("/api/state", "10.0.0.1:1000", "") },
+			second: func() *http.Request { return request("/api/volume", "10.0.0.1:1000", "") },
+		},
+		{
+			name:    "one identity behind two addresses",
+			first:   func() *http.Request { return request("/api/state", "10.0.0.1:1000", "alice") },
+			second:  func() *http.Request { return request("/api/state", "10.0.0.2:1000", "alice") },
+			limited: true,
+		},
+		{
+			name:   "two identities behind one address",
+			first:  func() *http.Request { return request("/api/state", "10.0.0.1:1000", "alice") },
+			second: func() *http.Request { return request("/api/state", "10.0.0.1:1000", "bob") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(Config{
+				Default:  Limit{RPS: 0.001, Burst: 1},
+				Routes:   []Route{{Prefix: "/api/volume", Limit: Limit{RPS: 0.001, Burst: 1}}},
+				Identity: func(r *http.Request) string { return r.Header.Get("X-User") },
+			})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			if w := serve(h, tt.first()); w.Code != http.StatusOK {
+				t.Fatalf("first status = %d, want 200", w.Code)
+			}
+			w := serve(h, tt.second())
+			if limited := w.Code == http.StatusTooManyRequests; limited != tt.limited {
+				t.Fatalf("second status = %d, want limited=%v", w.Code, tt.limited)
+			}
+			if tt.limited && w.Header().Get("Retry-After") == "" {
+				t.Errorf("429 without Retry-After")
+			}
+		})
+	}
+}
+
+func TestLimiterRouteOverride(t *testing.T) {
+	h := New(Config{
+		Default: Limit{RPS: 0.001, Burst: 10},
+		Routes: []Route{
+			{Prefix: "/api", Limit: Limit{RPS: 0.001, Burst: 5}},
+			{Prefix: "/api/volume", Limit: Limit{RPS: 0.001, Burst: 2}},
+		},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path    string
+		allowed int
+	}{
+		{"/api/volume", 2},
+		{"/api/state", 5},
+		{"/healthz", 10},
+	}
+	for _, tt := range tests {
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if serve(h, request(tt.path, "10.0.0.1:1000", "")).Code == http.StatusOK {
+				allowed++
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed %d requests, want %d", tt.path, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestLimiterEvictsBeyondMaxKeys(t *testing.T) {
+	h := New(Config{Default: Limit{RPS: 0.001, Burst: 1}, MaxKeys: 2})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve(h, request("/", "10.0.0.1:1000", ""))
+	serve(h, request("/", "10.0.0.2:1000", ""))
+	// A third client evicts the least recently used bucket, so the first
+	// client starts over with a full one.
+	serve(h, request("/", "10.0.0.3:1000", ""))
+	if w := serve(h, request("/", "10.0.0.1:1000", "")); w.Code != http.StatusOK {
+		t.Fatalf("evicted client status = %d, want 200", w.Code)
+	}
+	if w := serve(h, request("/", "10.0.0.3:1000", "")); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("kept client status = %d, want 429", w.Code)
+	}
+}
+
+func request(path, remoteAddr, user string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = remoteAddr
+	if user != "" {
+		r.Header.Set("X-User", user)
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
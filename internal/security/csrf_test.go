@@ -0,0 +1,85 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	type request struct {
+		method string
+		host   string
+		// cookie and bearer select how the request authenticates.
+		cookie bool
+		bearer bool
+		header bool
+		origin string
+		// referer is sent instead of Origin.
+		referer       string
+		forwardedHost string
+	}
+	tests := []struct {
+		name    string
+		req     request
+		allowed bool
+	}{
+		{name: "safe method", req: request{method: http.MethodGet, cookie: true, origin: "https://evil.example"}, allowed: true},
+		{name: "no cookie", req: request{method: http.MethodPost, origin: "https://evil.example"}, allowed: true},
+		{name: "bearer token", req: request{method: http.MethodPost, cookie: true, bearer: true, origin: "https://evil.example"}, allowed: true},
+		{name: "same origin", req: request{method: http.MethodPost, cookie: true, header: true, origin: "https://hn.local"}, allowed: true},
+		{name: "same origin, other case", req: request{method: http.MethodPut, cookie: true, header: true, origin: "HTTPS://HN.LOCAL"}, allowed: true},
+		{name: "same origin referer", req: request{method: http.MethodPost, cookie: true, header: true, referer: "https://hn.local/player?x=1"}, allowed: true},
+		{name: "forwarded host", req: request{method: http.MethodPost, host: "spotify:8099", cookie: true, header: true, origin: "https://hn.local", forwardedHost: "hn.local, proxy"}, allowed: true},
+		{name: "trusted origin", req: request{method: http.MethodDelete, cookie: true, header: true, origin: "https://ui.example:8443"}, allowed: true},
+		{name: "no origin or referer", req: request{method: http.MethodPost, cookie: true, header: true}, allowed: true},
+		{name: "missing header", req: request{method: http.MethodPost, cookie: true, origin: "https://hn.local"}},
+		{name: "cross-site origin", req: request{method: http.MethodPost, cookie: true, header: true, origin: "https://evil.example"}},
+		{name: "cross-site referer", req: request{method: http.MethodPost, cookie: true, header: true, referer: "https://evil.example/page"}},
+		{name: "trusted host on another port", req: request{method: http.MethodPost, cookie: true, header: true, origin: "https://ui.example"}},
+		{name: "opaque origin", req: request{method: http.MethodPost, cookie: true, header: true, origin: "null"}},
+		{name: "untrusted forwarded host", req: request{method: http.MethodPost, host: "spotify:8099", cookie: true, header: true, origin: "https://hn.local", forwardedHost: "proxy, hn.local"}},
+	}
+	h := CSRF(CSRFConfig{TrustedOrigins: []string{"https://UI.example:8443", "not an origin"}})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		host := tt.req.host
+		if host == "" {
+			host = "hn.local"
+		}
+		r := httptest.NewRequest(tt.req.method, "http://"+host+"/api/play", nil)
+		if tt.req.cookie {
+			r.AddCookie(&http.Cookie{Name: "auth_token", Value: "jwt"})
+		}
+		if tt.req.bearer {
+			r.Header.Set("Authorization", "Bearer jwt")
+		}
+		if tt.req.header {
+			r.Header.Set(CSRFHeader, "XMLHttpRequest")
+		}
+		if tt.req.origin != "" {
+			r.Header.Set("Origin", tt.req.origin)
+		}
+		if tt.req.referer != "" {
+			r.Header.Set("Referer", tt.req.referer)
+		}
+		if tt.req.forwardedHost != "" {
+			r.Header.Set("X-Forwarded-Host", tt.req.forwardedHost)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if allowed := w.Code == http.StatusOK; allowed != tt.allowed {
+			t.Errorf("%s: status = %d, want allowed=%v", tt.name, w.Code, tt.allowed)
+		}
+		if !tt.allowed && w.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", tt.name, w.Code)
+		}
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	got := ParseOrigins(" https://a.example, ,https://b.example ,")
+	if len(got) != 2 || got[0] != "https://a.example" || got[1] != "https://b.example" {
+		t.Fatalf("ParseOrigins = %q", got)
+	}
+}
@@ -1,22 +1,86 @@
 package security
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultCSP is designed for iframe delivery: default deny, and only allow
+// self-hosted resources. Album art is served through the same-origin
+// /api/image proxy, so no remote image origins are needed.
+var defaultCSP = []directive{
+	{"default-src", "'none'"},
+	{"base-uri", "'none'"},
+	{"object-src", "'none'"},
+	{"script-src", "'self'"},
+	{"style-src", "'self' 'unsafe-inline'"},
+	{"img-src", "'self' data:"},
+	{"connect-src", "'self'"},
+	{"frame-ancestors", "'self'"},
+}
+
+type directive struct {
+	name  string
+	value string
+}
+
+// BuildCSP applies per-deployment overrides to the default policy. Overrides
+// use CSP syntax ("img-src 'self' data:; frame-ancestors 'self' https://hn.local");
+// a directive replaces the default of the same name, a new one is appended,
+// and a directive with no value removes it.
+func BuildCSP(overrides string) (string, error) {
+	policy := append([]directive(nil), defaultCSP...)
+	for _, part := range strings.Split(overrides, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if strings.ContainsAny(name, "'\",") {
+			return "", fmt.Errorf("invalid CSP directive %q", fields[0])
+		}
+		value := strings.Join(fields[1:], " ")
+		replaced := false
+		for i := range policy {
+			if policy[i].name == name {
+				policy[i].value = value
+				replaced = true
+			}
+		}
+		if !replaced {
+			policy = append(policy, directive{name: name, value: value})
+		}
+	}
+	parts := make([]string, 0, len(policy))
+	for _, d := range policy {
+		if d.value == "" {
+			continue
+		}
+		parts = append(parts, d.name+" "+d.value)
+	}
+	return strings.Join(parts, "; "), nil
+}
 
 func SecurityHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("Referrer-Policy", "no-referrer")
-		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
-		w.Header().Set("Permissions-Policy", "accelerometer=(), ambient-light-sensor=(), autoplay=(), battery=(), camera=(), clipboard-read=(), clipboard-write=(), display-capture=(), encrypted-media=(), fullscreen=(), geolocation=(), gyroscope=(), magnetometer=(), microphone=(), midi=(), payment=(), picture-in-picture=(), publickey-credentials-get=(), usb=()")
-
-		// Designed for iframe delivery: default deny, and only allow self-hosted resources.
-		// NOTE: A host-side <iframe sandbox> is still required for strong isolation.
-		w.Header().Set("Content-Security-Policy",
-			"default-src 'none'; base-uri 'none'; object-src 'none'; "+
-				"script-src 'self'; style-src 'self' 'unsafe-inline'; "+
-				"img-src 'self' data: https: https://i.scdn.co https://*.scdn.co; "+
-				"connect-src 'self'; frame-ancestors 'self'")
-
-		next.ServeHTTP(w, r)
-	})
+	csp, _ := BuildCSP("")
+	return WithSecurityHeaders(csp)(next)
+}
+
+// WithSecurityHeaders sets the standard response headers with the given
+// Content-Security-Policy.
+func WithSecurityHeaders(csp string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+			w.Header().Set("Permissions-Policy", "accelerometer=(), ambient-light-sensor=(), autoplay=(), battery=(), camera=(), clipboard-read=(), clipboard-write=(), display-capture=(), encrypted-media=(), fullscreen=(), geolocation=(), gyroscope=(), magnetometer=(), microphone=(), midi=(), payment=(), picture-in-picture=(), publickey-credentials-get=(), usb=()")
+
+			// NOTE: A host-side <iframe sandbox> is still required for strong isolation.
+			w.Header().Set("Content-Security-Policy", csp)
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver is a minimal OTLP/HTTP trace endpoint that keeps every span it
+// is sent.
+type receiver struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			rc.spans = append(rc.spans, ss.Spans...)
+		}
+	}
+	rc.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	_, _ = w.Write(out)
+}
+
+func spanAttr(span *tracepb.Span, key string) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestSpansAreNamedAfterRouteTemplate(t *testing.T) {
+	rc := &receiver{}
+	collector := httptest.NewServer(rc)
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("OTEL_TRACES_SAMPLER", "always_on")
+
+	shutdown, err := Setup(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/albums/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/albums/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/", http.NotFound)
+	srv := httptest.NewServer(Middleware(Routes(mux)))
+	defer srv.Close()
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/api/albums/abc"},
+		{http.MethodGet, "/api/albums/def"},
+		{http.MethodPost, "/api/albums/ghi"},
+		{http.MethodGet, "/healthz"},
+	} {
+		r, _ := http.NewRequest(req.method, srv.URL+req.path, nil)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", req.method, req.path, err)
+		}
+		resp.Body.Close()
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var names []string
+	for _, span := range rc.spans {
+		names = append(names, span.Name)
+	}
+	want := []string{"GET /api/albums/{id}", "GET /api/albums/{id}", "POST /api/albums/{id}"}
+	if len(names) != len(want) {
+		t.Fatalf("span names = %q, want %q", names, want)
+	}
+	for i, span := range rc.spans {
+		if span.Name != want[i] {
+			t.Errorf("span %d name = %q, want %q", i, span.Name, want[i])
+		}
+		if got := spanAttr(span, "http.route"); got != "/api/albums/{id}" {
+			t.Errorf("span %d http.route = %q, want /api/albums/{id}", i, got)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homenavi/spotify-integration/internal/clientip"
+	"github.com/homenavi/spotify-integration/internal/requestid"
+)
+
+const auditBodyLimit = 64 << 10
+
+type AuditEntry struct {
+	Time      time.Time      `json:"time"`
+	Action    string         `json:"action"`
+	Subject   string         `json:"subject,omitempty"`
+	Role      string         `json:"role,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	SourceIP  string         `json:"source_ip,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Params    map[string]any `json:"params,omitempty"`
+	Status    int            `json:"status"`
+	Result    string         `json:"result,omitempty"`
+}
+
+type AuditFilter struct {
+	Subject string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+	Errors  bool
+	Limit   int
+}
+
+// AuditLog is an append-only JSON lines file. When the active file grows past
+// maxBytes it is rotated to path.1, path.2, ... keeping at most maxFiles.
+type AuditLog struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	mu       sync.Mutex
+}
+
+func NewAuditLog(path string, maxBytes int64, maxFiles int) *AuditLog {
+	if maxBytes <= 0 {
+		maxBytes = 5 << 20
+	}
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+	return &AuditLog{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+}
+
+func NewAuditLogFromEnv() *AuditLog {
+	path := Getenv("AUDIT_LOG_PATH", filepath.Join("config", "audit.jsonl"))
+	maxBytes := int64(GetenvInt("AUDIT_LOG_MAX_BYTES", 5<<20))
+	maxFiles := GetenvInt("AUDIT_LOG_MAX_FILES", 5)
+	return NewAuditLog(filepath.Clean(path), maxBytes, maxFiles)
+}
+
+func (l *AuditLog) Record(entry AuditEntry) {
+	if l == nil || strings.TrimSpace(l.path) == "" {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("audit: marshal entry", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.appendUnlocked(line); err != nil {
+		slog.Error("audit: write entry", "err", err)
+	}
+}
+
+func (l *AuditLog) appendUnlocked(line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(l.path); err == nil && info.Size()+int64(len(line)) > l.maxBytes {
+		if err := l.rotateUnlocked(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (l *AuditLog) rotateUnlocked() error {
+	oldest := l.rotatedPath(l.maxFiles - 1)
+	if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := l.maxFiles - 2; i >= 1; i-- {
+		if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.maxFiles == 1 {
+		return os.Remove(l.path)
+	}
+	return os.Rename(l.path, l.rotatedPath(1))
+}
+
+func (l *AuditLog) rotatedPath(i int) string {
+	if i <= 0 {
+		return l.path
+	}
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Query returns matching entries, newest first.
+func (l *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := []AuditEntry{}
+	// Files are read newest first; entries within a file are appended in
+	// order, so each file is reversed before being merged.
+	for i := 0; i < l.maxFiles && len(out) < filter.Limit; i++ {
+		entries, err := readAuditFile(l.rotatedPath(i))
+		if err != nil {
+			return nil, err
+		}
+		for j := len(entries) - 1; j >= 0 && len(out) < filter.Limit; j-- {
+			if filter.matches(entries[j]) {
+				out = append(out, entries[j])
+			}
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Time.After(out[b].Time) })
+	return out, nil
+}
+
+func readAuditFile(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path) // #nosec G304 -- path comes from env/config
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var out []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out, scanner.Err()
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	if f.Subject != "" && e.Subject != f.Subject {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action && !strings.HasPrefix(e.Action, f.Action+".") {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Errors && e.Status < http.StatusBadRequest {
+		return false
+	}
+	return true
+}
+
+// newAuditEntry fills in the caller identity and request metadata.
+func newAuditEntry(r *http.Request, auth *AdminAuth, action string) AuditEntry {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		SourceIP:  clientip.FromRequest(r),
+		RequestID: requestid.FromContext(r.Context()),
+	}
+	if claims, ok := auth.Identify(r); ok {
+		entry.Subject = claims.Subject
+		entry.Role = claims.Role
+		entry.Name = claims.Name
+	}
+	return entry
+}
+
+// AuditMiddleware records every mutating /api/* call. Admin routes are
+// skipped; they audit themselves so secret values never reach the log.
+func AuditMiddleware(l *AuditLog, auth *AdminAuth, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/admin/") || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		action := strings.ReplaceAll(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/", ".")
+		entry := newAuditEntry(r, auth, action)
+		entry.Params = auditParams(r)
+
+		rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry.Status = rec.status
+		entry.Result = rec.result()
+		l.Record(entry)
+	})
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// auditParams captures the query string and JSON body, then restores the body
+// for the handler.
+func auditParams(r *http.Request) map[string]any {
+	params := map[string]any{}
+	for key, values := range r.URL.Query() {
+		if len(values) == 1 {
+			params[key] = values[0]
+		} else {
+			params[key] = values
+		}
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		data, err := io.ReadAll(io.LimitReader(r.Body, auditBodyLimit))
+		if err == nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+			var body map[string]any
+			if json.Unmarshal(data, &body) == nil {
+				for key, value := range body {
+					params[key] = value
+				}
+			}
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if r.status >= http.StatusBadRequest && r.body.Len() < 1024 {
+		r.body.Write(p[:min(len(p), 1024-r.body.Len())])
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *auditRecorder) result() string {
+	if r.status < http.StatusBadRequest {
+		return "ok"
+	}
+	var payload struct {
+		Error any `json:"error"`
+	}
+	if json.Unmarshal(r.body.Bytes(), &payload) == nil && payload.Error != nil {
+		if msg, ok := payload.Error.(string); ok {
+			return msg
+		}
+		if data, err := json.Marshal(payload.Error); err == nil {
+			return string(data)
+		}
+	}
+	if text := strings.TrimSpace(r.body.String()); text != "" {
+		return text
+	}
+	return http.StatusText(r.status)
+}
+
+type AuditAPI struct {
+	Log   *AuditLog
+	Admin *AdminAuth
+}
+
+func NewAuditAPI(l *AuditLog, admin *AdminAuth) *AuditAPI {
+	return &AuditAPI{Log: l, Admin: admin}
+}
+
+func (a *AuditAPI) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/admin/audit", a.handleAudit)
+}
+
+func (a *AuditAPI) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if a == nil || a.Admin == nil || !a.Admin.RequireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed([]string{http.MethodGet}).ServeHTTP(w, r)
+		return
+	}
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Subject: strings.TrimSpace(q.Get("subject")),
+		Action:  strings.TrimSpace(q.Get("action")),
+		Errors:  q.Get("errors") == "true",
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(q.Get("since")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid since")
+		return
+	}
+	if filter.Until, err = parseAuditTime(q.Get("until")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid until")
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+	entries, err := a.Log.Query(filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// parseAuditTime accepts RFC 3339 timestamps or a duration relative to now
+// (e.g. "24h").
+func parseAuditTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", v)
+	}
+	return time.Now().Add(-d), nil
+}
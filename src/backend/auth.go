@@ -2,6 +2,7 @@ package backend
 
 import (
 	"crypto/rsa"
+	"errors"
 	"net/http"
 	"os"
 	"strings"
@@ -41,28 +42,55 @@ func (a *AdminAuth) RequireAdmin(w http.ResponseWriter, r *http.Request) bool {
 		writeJSONError(w, http.StatusServiceUnavailable, "admin auth not configured")
 		return false
 	}
+	claims, err := a.parseClaims(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	if !roleAtLeast("admin", strings.TrimSpace(claims.Role)) {
+		writeJSONError(w, http.StatusForbidden, "forbidden")
+		return false
+	}
+	return true
+}
+
+// Identify returns the verified claims of the caller, if any. Unlike
+// RequireAdmin it never rejects the request.
+func (a *AdminAuth) Identify(r *http.Request) (*Claims, bool) {
+	if a == nil || !a.enabled || a.pubKey == nil {
+		return nil, false
+	}
+	claims, err := a.parseClaims(r)
+	if err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// Subject returns the verified JWT subject of the caller, or "".
+func (a *AdminAuth) Subject(r *http.Request) string {
+	if claims, ok := a.Identify(r); ok {
+		return claims.Subject
+	}
+	return ""
+}
+
+func (a *AdminAuth) parseClaims(r *http.Request) (*Claims, error) {
 	tokenStr := extractToken(r)
 	if tokenStr == "" {
-		writeJSONError(w, http.StatusUnauthorized, "missing token")
-		return false
+		return nil, errors.New("missing token")
 	}
 	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return a.pubKey, nil
 	})
 	if err != nil || !token.Valid {
-		writeJSONError(w, http.StatusUnauthorized, "invalid token")
-		return false
+		return nil, errors.New("invalid token")
 	}
 	claims, ok := token.Claims.(*Claims)
 	if !ok {
-		writeJSONError(w, http.StatusUnauthorized, "invalid claims")
-		return false
+		return nil, errors.New("invalid claims")
 	}
-	if !roleAtLeast("admin", strings.TrimSpace(claims.Role)) {
-		writeJSONError(w, http.StatusForbidden, "forbidden")
-		return false
-	}
-	return true
+	return claims, nil
 }
 
 func extractToken(r *http.Request) string {
@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	maxBatchSteps = 20
+	maxStepDelay  = 5 * time.Second
+	// maxBatchDelay keeps a batch, delays included, within batchTimeout.
+	maxBatchDelay = 8 * time.Second
+)
+
+const (
+	onErrorStop     = "stop"
+	onErrorContinue = "continue"
+)
+
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+// batchOps maps each batch op to a new request for its args. The ops run
+// the same commands as the single routes.
+var batchOps = map[string]func() commandRequest{
+	"play":      func() commandRequest { return &playRequest{} },
+	"pause":     func() commandRequest { return &noArgs{build: pauseCommand} },
+	"toggle":    func() commandRequest { return &noArgs{build: toggleCommand} },
+	"next":      func() commandRequest { return &noArgs{build: nextCommand} },
+	"previous":  func() commandRequest { return &noArgs{build: previousCommand} },
+	"shuffle":   func() commandRequest { return &shuffleRequest{} },
+	"repeat":    func() commandRequest { return &repeatRequest{} },
+	"volume":    func() commandRequest { return &volumeRequest{} },
+	"mute":      func() commandRequest { return &muteRequest{} },
+	"unmute":    func() commandRequest { return &unmuteRequest{} },
+	"seek":      func() commandRequest { return &seekRequest{} },
+	"queue.add": func() commandRequest { return &queueAddRequest{} },
+	"transfer":  func() commandRequest { return &transferRequest{} },
+}
+
+// noArgs is the request for commands that take no arguments.
+type noArgs struct {
+	build func() playerCommand
+}
+
+func (n *noArgs) command() (playerCommand, *apiError) {
+	return n.build(), nil
+}
+
+type batchRequest struct {
+	Steps   []batchStep `json:"steps"`
+	OnError string      `json:"on_error"`
+}
+
+type batchStep struct {
+	Op      string          `json:"op"`
+	Args    json.RawMessage `json:"args"`
+	DelayMS int             `json:"delay_ms"`
+}
+
+type batchStepResult struct {
+	Index      int       `json:"index"`
+	Op         string    `json:"op"`
+	Status     string    `json:"status"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	Error      *apiError `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+type batchResponse struct {
+	Status string            `json:"status"`
+	Steps  []batchStepResult `json:"steps"`
+	State  json.RawMessage   `json:"state,omitempty"`
+}
+
+// handleBatch runs an ordered list of player commands, e.g. a morning
+// routine of transfer, volume, shuffle and play. Every step is validated
+// before the first one is sent.
+func (a *API) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var payload batchRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cmds, apiErr := payload.commands()
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	continueOnError := payload.OnError == onErrorContinue
+
+	out := batchResponse{Status: "completed", Steps: make([]batchStepResult, len(cmds))}
+	stopped := false
+	for i, cmd := range cmds {
+		result := &out.Steps[i]
+		*result = batchStepResult{Index: i, Op: payload.Steps[i].Op, Status: stepSkipped}
+		if stopped {
+			continue
+		}
+		start := time.Now()
+		relative := cmd.relative != nil
+		if apiErr := sleepContext(r, time.Duration(payload.Steps[i].DelayMS)*time.Millisecond); apiErr != nil {
+			result.Status, result.Error = stepFailed, apiErr
+		} else if cmd, apiErr = a.resolve(r.Context(), cmd); apiErr != nil {
+			result.Status, result.Error = stepFailed, apiErr
+		} else if res := a.send(r.Context(), cmd); res.err != nil {
+			if relative {
+				a.Playback.Retract(cmd.effects)
+			}
+			result.Status, result.Error = stepFailed, spotifyAPIError(res.err)
+		} else {
+			result.Status, result.HTTPStatus = stepOK, res.status
+			if len(res.cmd.effects) > 0 {
+				a.Playback.Project(res.cmd.effects)
+			}
+		}
+		result.DurationMS = time.Since(start).Milliseconds()
+		if result.Status == stepFailed {
+			result.HTTPStatus = result.Error.Status
+			out.Status = "partial"
+			if !continueOnError || r.Context().Err() != nil {
+				out.Status, stopped = "failed", true
+			}
+		}
+	}
+	if state, ok := a.Playback.Get(); ok {
+		out.State = state
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// commands validates every step and builds its command.
+func (b batchRequest) commands() ([]playerCommand, *apiError) {
+	switch b.OnError {
+	case "", onErrorStop, onErrorContinue:
+	default:
+		return nil, invalidField("on_error", "on_error must be stop or continue")
+	}
+	if len(b.Steps) == 0 {
+		return nil, invalidField("steps", "steps must not be empty")
+	}
+	if len(b.Steps) > maxBatchSteps {
+		return nil, invalidField("steps", "steps accepts at most %d entries", maxBatchSteps)
+	}
+	var totalDelay time.Duration
+	cmds := make([]playerCommand, 0, len(b.Steps))
+	for i, step := range b.Steps {
+		field := fmt.Sprintf("steps[%d]", i)
+		newRequest, ok := batchOps[step.Op]
+		if !ok {
+			return nil, invalidField(field+".op", "%s.op %q is not a known command", field, step.Op)
+		}
+		delay := time.Duration(step.DelayMS) * time.Millisecond
+		if step.DelayMS < 0 || delay > maxStepDelay {
+			return nil, invalidField(field+".delay_ms", "%s.delay_ms must be between 0 and %d", field, maxStepDelay.Milliseconds())
+		}
+		totalDelay += delay
+		if totalDelay > maxBatchDelay {
+			return nil, invalidField(field+".delay_ms", "delays add up to more than %d ms", maxBatchDelay.Milliseconds())
+		}
+		req := newRequest()
+		if apiErr := decodeArgs(step.Args, req); apiErr != nil {
+			return nil, stepError(field+".args", apiErr)
+		}
+		cmd, apiErr := req.command()
+		if apiErr != nil {
+			return nil, stepError(field+".args", apiErr)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// decodeArgs decodes a step's args like a route body; missing args are an
+// empty object.
+func decodeArgs(raw json.RawMessage, dst any) *apiError {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		raw = []byte("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err, false)
+	}
+	return nil
+}
+
+// stepError qualifies a validation error with the step it belongs to.
+func stepError(prefix string, apiErr *apiError) *apiError {
+	out := *apiErr
+	if out.Field != "" {
+		out.Field = prefix + "." + out.Field
+	} else {
+		out.Field = prefix
+	}
+	out.Message = prefix + ": " + out.Message
+	return &out
+}
+
+func sleepContext(r *http.Request, d time.Duration) *apiError {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return spotifyAPIError(r.Context().Err())
+	}
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		steps int
+		// field is the field a rejected batch must name.
+		field string
+	}{
+		{name: "single step", body: `{"steps":[{"op":"pause"}]}`, steps: 1},
+		{name: "routine", body: `{"on_error":"continue","steps":[` +
+			`{"op":"transfer","args":{"device_id":"speaker"}},` +
+			`{"op":"volume","args":{"volume_percent":30},"delay_ms":500},` +
+			`{"op":"shuffle","args":{"state":true}},` +
+			`{"op":"play","args":{"context_uri":"spotify:album:4uLU6hMCjMI75M1A2tKUQC"}}]}`, steps: 4},
+		{name: "null args", body: `{"steps":[{"op":"next","args":null}]}`, steps: 1},
+		{name: "no steps", body: `{"steps":[]}`, field: "steps"},
+		{name: "too many steps", body: `{"steps":[` + strings.Repeat(`{"op":"next"},`, maxBatchSteps) + `{"op":"next"}]}`, field: "steps"},
+		{name: "bad on_error", body: `{"on_error":"retry","steps":[{"op":"next"}]}`, field: "on_error"},
+		{name: "unknown op", body: `{"steps":[{"op":"next"},{"op":"rewind"}]}`, field: "steps[1].op"},
+		{name: "negative delay", body: `{"steps":[{"op":"next","delay_ms":-1}]}`, field: "steps[0].delay_ms"},
+		{name: "step delay too long", body: `{"steps":[{"op":"next","delay_ms":5001}]}`, field: "steps[0].delay_ms"},
+		{name: "delays add up", body: `{"steps":[{"op":"next","delay_ms":5000},{"op":"next","delay_ms":3001}]}`, field: "steps[1].delay_ms"},
+		{name: "invalid args", body: `{"steps":[{"op":"volume","args":{"volume_percent":101}}]}`, field: "steps[0].args.volume_percent"},
+		{name: "missing args", body: `{"steps":[{"op":"volume"}]}`, field: "steps[0].args.volume_percent"},
+		{name: "unknown arg", body: `{"steps":[{"op":"pause","args":{"device":"x"}}]}`, field: "steps[0].args.device"},
+	}
+	for _, tt := range tests {
+		var req batchRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		cmds, apiErr := req.commands()
+		if tt.field == "" {
+			if apiErr != nil {
+				t.Errorf("%s: %v", tt.name, apiErr)
+			} else if len(cmds) != tt.steps {
+				t.Errorf("%s: %d commands, want %d", tt.name, len(cmds), tt.steps)
+			}
+			continue
+		}
+		if apiErr == nil {
+			t.Errorf("%s: accepted, want an error for %s", tt.name, tt.field)
+		} else if apiErr.Status != http.StatusBadRequest || apiErr.Field != tt.field {
+			t.Errorf("%s: error = %+v, want a 400 for %s", tt.name, apiErr, tt.field)
+		}
+	}
+}
+
+func TestBatchOnError(t *testing.T) {
+	tests := []struct {
+		onError string
+		status  string
+		steps   []string
+	}{
+		{onError: "", status: "failed", steps: []string{stepOK, stepFailed, stepSkipped}},
+		{onError: onErrorStop, status: "failed", steps: []string{stepOK, stepFailed, stepSkipped}},
+		{onError: onErrorContinue, status: "partial", steps: []string{stepOK, stepFailed, stepOK}},
+	}
+	for _, tt := range tests {
+		stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/me/player/next" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"error":{"status":403,"message":"Player command failed: Restriction violated","reason":"UNKNOWN"}}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		spotify := newTestSpotifyClient()
+		presetToken(spotify, "access")
+		a := NewAPI(spotify, NewPlaybackCache())
+
+		body := `{"on_error":"` + tt.onError + `","steps":[{"op":"pause"},{"op":"next"},{"op":"shuffle","args":{"state":true}}]}`
+		w := httptest.NewRecorder()
+		a.handleBatch(w, httptest.NewRequest(http.MethodPost, "/api/batch", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("on_error %q: status = %d %s", tt.onError, w.Code, w.Body)
+		}
+		var out batchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Status != tt.status {
+			t.Errorf("on_error %q: batch status = %q, want %q", tt.onError, out.Status, tt.status)
+		}
+		for i, step := range out.Steps {
+			if step.Status != tt.steps[i] {
+				t.Errorf("on_error %q: step %d = %q, want %q", tt.onError, i, step.Status, tt.steps[i])
+			}
+		}
+	}
+}
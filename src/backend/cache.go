@@ -1,14 +1,41 @@
 package backend
 
 import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// projectionTTL bounds how long a command's projected effect overrides
+	// snapshots that disagree with it; Spotify usually catches up within a
+	// second or two.
+	projectionTTL = 5 * time.Second
+	// positionTolerance is how far a snapshot's progress_ms may be from the
+	// projected position and still confirm it.
+	positionTolerance = 2000
+)
+
+// PlaybackCache holds the last playback snapshot from Spotify plus the
+// projected effects of commands sent since. Get returns the snapshot with
+// those effects applied; each new snapshot drops the effects it confirms.
 type PlaybackCache struct {
 	mu        sync.RWMutex
 	payload   []byte
 	updatedAt time.Time
+	overlays  map[string]overlay
+	// restored is set while the snapshot comes from a previous run, whose
+	// projections were lost.
+	restored bool
+}
+
+type overlay struct {
+	effect  stateEffect
+	setAt   time.Time
+	expires time.Time
 }
 
 func NewPlaybackCache() *PlaybackCache {
@@ -22,6 +49,8 @@ func (c *PlaybackCache) Set(payload []byte) {
 	c.mu.Lock()
 	c.payload = append([]byte(nil), payload...)
 	c.updatedAt = time.Now()
+	c.restored = false
+	c.reconcileLocked()
 	c.mu.Unlock()
 }
 
@@ -30,11 +59,268 @@ func (c *PlaybackCache) Get() ([]byte, bool) {
 		return nil, false
 	}
 	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.payload) == 0 {
+		return nil, false
+	}
+	return c.projectedLocked(time.Now()), true
+}
+
+// Project records the effects of a command Spotify has accepted and returns
+// the resulting playback state. It reports false when nothing is cached to
+// project onto.
+func (c *PlaybackCache) Project(effects []stateEffect) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.payload) == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	if c.overlays == nil {
+		c.overlays = map[string]overlay{}
+	}
+	for _, effect := range effects {
+		c.overlays[strings.Join(effect.path, ".")] = overlay{effect: effect, setAt: now, expires: now.Add(projectionTTL)}
+	}
+	return c.projectedLocked(now), true
+}
+
+// Retract drops the projections of effects, for a command that failed
+// after its effects were projected. Projections a later command replaced
+// are kept.
+func (c *PlaybackCache) Retract(effects []stateEffect) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, effect := range effects {
+		key := strings.Join(effect.path, ".")
+		if ov, ok := c.overlays[key]; ok && sameJSONValue(ov.effect.value, effect.value) {
+			delete(c.overlays, key)
+		}
+	}
+}
+
+// current returns the projected state as a map with progress_ms advanced
+// to now, provided the snapshot is at most maxAge old.
+func (c *PlaybackCache) current(maxAge time.Duration) (map[string]any, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now()
+	if len(c.payload) == 0 || c.restored || now.Sub(c.updatedAt) > maxAge {
+		return nil, false
+	}
+	state, ok := decodeState(c.projectedLocked(now))
+	if !ok {
+		return nil, false
+	}
+	if ov, projected := c.overlays["progress_ms"]; !projected || !now.Before(ov.expires) {
+		playing, _ := state["is_playing"].(bool)
+		if progress, ok := getStatePath(state, []string{"progress_ms"}); ok {
+			base := stateEffect{path: []string{"progress_ms"}, value: progress, advances: true}
+			setStatePath(state, base.path, expectedPosition(state, base, c.updatedAt, playing, now))
+		}
+	}
+	return state, true
+}
+
+// UpdatedAt returns when the cached playback state was last written.
+func (c *PlaybackCache) UpdatedAt() (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.updatedAt, len(c.payload) > 0
+}
+
+// snapshot returns the last snapshot from Spotify, without projections.
+func (c *PlaybackCache) snapshot() ([]byte, time.Time, bool) {
+	if c == nil {
+		return nil, time.Time{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if len(c.payload) == 0 {
-		c.mu.RUnlock()
+		return nil, time.Time{}, false
+	}
+	return append([]byte(nil), c.payload...), c.updatedAt, true
+}
+
+// restore loads a persisted snapshot unless a newer one was already cached.
+func (c *PlaybackCache) restore(payload []byte, updatedAt time.Time) {
+	if c == nil || len(payload) == 0 {
+		return
+	}
+	c.mu.Lock()
+	if c.updatedAt.Before(updatedAt) {
+		c.payload = append([]byte(nil), payload...)
+		c.updatedAt = updatedAt
+		c.restored = true
+	}
+	c.mu.Unlock()
+}
+
+// projectedLocked returns the snapshot with unexpired overlays applied.
+func (c *PlaybackCache) projectedLocked(now time.Time) []byte {
+	active := c.activeOverlays(now)
+	if len(active) == 0 {
+		return append([]byte(nil), c.payload...)
+	}
+	state, ok := decodeState(c.payload)
+	if !ok {
+		return append([]byte(nil), c.payload...)
+	}
+	for _, ov := range active {
+		if !ov.effect.advances {
+			setStatePath(state, ov.effect.path, ov.effect.value)
+		}
+	}
+	// Positions advance from when they were set, but only while playing,
+	// which may itself be projected.
+	playing, _ := state["is_playing"].(bool)
+	for _, ov := range active {
+		if ov.effect.advances {
+			setStatePath(state, ov.effect.path, expectedPosition(state, ov.effect, ov.setAt, playing, now))
+		}
+	}
+	out, err := json.Marshal(state)
+	if err != nil {
+		return append([]byte(nil), c.payload...)
+	}
+	return out
+}
+
+// reconcileLocked drops overlays that the new snapshot confirms or that have
+// outlived projectionTTL. The rest keep overriding the snapshot until
+// Spotify catches up.
+func (c *PlaybackCache) reconcileLocked() {
+	if len(c.overlays) == 0 {
+		return
+	}
+	now := time.Now()
+	state, ok := decodeState(c.payload)
+	if !ok {
+		c.overlays = nil
+		return
+	}
+	for key, ov := range c.overlays {
+		if !now.Before(ov.expires) || confirms(state, ov.effect, ov.setAt, now) {
+			delete(c.overlays, key)
+		}
+	}
+}
+
+func (c *PlaybackCache) activeOverlays(now time.Time) []overlay {
+	var active []overlay
+	for _, ov := range c.overlays {
+		if now.Before(ov.expires) {
+			active = append(active, ov)
+		}
+	}
+	return active
+}
+
+// confirms reports whether state shows effect, applied at setAt, has taken
+// hold.
+func confirms(state map[string]any, effect stateEffect, setAt, now time.Time) bool {
+	actual, found := getStatePath(state, effect.path)
+	if !found {
+		return false
+	}
+	if effect.advances {
+		playing, _ := state["is_playing"].(bool)
+		return math.Abs(toFloat(actual)-expectedPosition(state, effect, setAt, playing, now)) <= positionTolerance
+	}
+	return sameJSONValue(actual, effect.value)
+}
+
+// expectedPosition is where a position set at setAt should be by now,
+// capped at the current item's duration.
+func expectedPosition(state map[string]any, effect stateEffect, setAt time.Time, playing bool, now time.Time) float64 {
+	pos := toFloat(effect.value)
+	if playing {
+		pos += float64(now.Sub(setAt).Milliseconds())
+	}
+	if item, ok := state["item"].(map[string]any); ok {
+		if duration := toFloat(item["duration_ms"]); duration > 0 && pos > duration {
+			pos = duration
+		}
+	}
+	return math.Round(pos)
+}
+
+func decodeState(payload []byte) (map[string]any, bool) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var state map[string]any
+	if err := dec.Decode(&state); err != nil || state == nil {
 		return nil, false
 	}
-	payload := append([]byte(nil), c.payload...)
-	c.mu.RUnlock()
-	return payload, true
+	return state, true
+}
+
+func getStatePath(state map[string]any, path []string) (any, bool) {
+	var cur any = state
+	for _, key := range path {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setStatePath sets the field at path. Missing parent objects are not
+// created: there is no device to project a volume onto, for example.
+func setStatePath(state map[string]any, path []string, value any) {
+	m := state
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]any)
+		if !ok {
+			return
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+}
+
+func sameJSONValue(a, b any) bool {
+	if na, ok := numeric(a); ok {
+		nb, ok := numeric(b)
+		return ok && na == nb
+	}
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+func numeric(v any) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func toFloat(v any) float64 {
+	f, _ := numeric(v)
+	return f
 }
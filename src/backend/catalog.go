@@ -0,0 +1,545 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPageLimit is the largest page Spotify serves for catalog lists.
+	maxPageLimit = 50
+	// maxCatalogOffset bounds pagination through album tracks and an
+	// artist's albums.
+	maxCatalogOffset = 10000
+
+	defaultAlbumTrackLimit  = 50
+	defaultArtistAlbumLimit = 20
+
+	profileMarketTTL = time.Hour
+	// profileRetryAfter keeps a failing profile read from being repeated on
+	// every request.
+	profileRetryAfter = time.Minute
+)
+
+var marketPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// catalogItem is the normalized model that search results and the album
+// and artist routes map every Spotify catalog object to.
+type catalogItem struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Subtitle    string `json:"subtitle,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	DurationMS  int    `json:"duration_ms,omitempty"`
+	Explicit    bool   `json:"explicit,omitempty"`
+	Popularity  int    `json:"popularity,omitempty"`
+	ReleaseDate string `json:"release_date,omitempty"`
+	TotalTracks int    `json:"total_tracks,omitempty"`
+	TrackNumber int    `json:"track_number,omitempty"`
+	DiscNumber  int    `json:"disc_number,omitempty"`
+	// Group is album, single, compilation or appears_on for an artist's
+	// albums.
+	Group     string   `json:"group,omitempty"`
+	Followers int      `json:"followers,omitempty"`
+	Genres    []string `json:"genres,omitempty"`
+	// Album and Artists link to the detail routes.
+	Album   *spotifyNamed  `json:"album,omitempty"`
+	Artists []spotifyNamed `json:"artists,omitempty"`
+	// Playable is only known when Spotify applied a market.
+	Playable *bool `json:"playable,omitempty"`
+	// Play is the body to POST to /api/play for this item.
+	Play playRequest `json:"play"`
+	// Queueable reports whether the item can go to /api/queue/add.
+	Queueable bool `json:"queueable"`
+}
+
+type catalogPage struct {
+	Items  []catalogItem `json:"items"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	// NextOffset is the offset of the next page, or absent on the last one.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type albumResponse struct {
+	catalogItem
+	Label  string      `json:"label,omitempty"`
+	Tracks catalogPage `json:"tracks"`
+}
+
+type artistResponse struct {
+	catalogItem
+	// TopTracks and RelatedArtists are only included on the first page of
+	// albums; related artists are left out when Spotify does not serve them.
+	TopTracks      []catalogItem `json:"top_tracks,omitempty"`
+	Albums         catalogPage   `json:"albums"`
+	RelatedArtists []catalogItem `json:"related_artists,omitempty"`
+}
+
+// handleAlbum serves an album with a page of its tracks. Each track plays
+// the album from that track on.
+func (a *API) handleAlbum(w http.ResponseWriter, r *http.Request) {
+	id, apiErr := pathSpotifyID(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	limit, offset, apiErr := parsePage(r.URL.Query(), defaultAlbumTrackLimit, maxCatalogOffset)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	market, apiErr := a.requestMarket(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var album spotifyAlbum
+	if apiErr := a.getJSON(r.Context(), "/albums/"+id, marketQuery(market), &album); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	// The album embeds its first page of tracks; later pages are read
+	// separately.
+	tracks := album.Tracks
+	if len(tracks.Items) > limit {
+		tracks.Items = tracks.Items[:limit]
+	}
+	if offset > 0 {
+		query := marketQuery(market)
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		tracks = spotifyPage{}
+		if apiErr := a.getJSON(r.Context(), "/albums/"+id+"/tracks", query, &tracks); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+	}
+
+	out := albumResponse{catalogItem: album.normalize("album"), Label: album.Label}
+	out.Tracks = tracks.normalize("track", offset, limit)
+	ref := &spotifyNamed{ID: album.ID, Name: album.Name}
+	for i := range out.Tracks.Items {
+		track := &out.Tracks.Items[i]
+		track.Album = ref
+		if track.ImageURL == "" {
+			track.ImageURL = out.ImageURL
+		}
+		track.Play = playRequest{ContextURI: album.URI, Offset: &playOffset{URI: track.URI}}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleArtist serves an artist with their top tracks, a page of albums and
+// singles, and related artists. Top tracks play as a list from the chosen
+// track on.
+func (a *API) handleArtist(w http.ResponseWriter, r *http.Request) {
+	id, apiErr := pathSpotifyID(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	limit, offset, apiErr := parsePage(r.URL.Query(), defaultArtistAlbumLimit, maxCatalogOffset)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	market, apiErr := a.requestMarket(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var (
+		wg                           sync.WaitGroup
+		artist                       spotifyItem
+		albums                       spotifyPage
+		top                          struct{ Tracks []*spotifyItem }
+		related                      struct{ Artists []*spotifyItem }
+		artistErr, albumsErr, topErr *apiError
+	)
+	base := "/artists/" + id
+	fetch := func(path string, query url.Values, dst any, errOut **apiError) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			*errOut = a.getJSON(r.Context(), path, query, dst)
+		}()
+	}
+	fetch(base, nil, &artist, &artistErr)
+	albumsQuery := marketQuery(market)
+	albumsQuery.Set("include_groups", "album,single")
+	albumsQuery.Set("limit", strconv.Itoa(limit))
+	albumsQuery.Set("offset", strconv.Itoa(offset))
+	fetch(base+"/albums", albumsQuery, &albums, &albumsErr)
+	if offset == 0 {
+		topQuery := marketQuery(market)
+		if market == "" {
+			// Top tracks require a market.
+			topQuery.Set("market", "from_token")
+		}
+		fetch(base+"/top-tracks", topQuery, &top, &topErr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Spotify no longer serves related artists to every app, so a
+			// failure only leaves them out.
+			if apiErr := a.getJSON(r.Context(), base+"/related-artists", nil, &related); apiErr != nil {
+				slog.DebugContext(r.Context(), "related artists unavailable", "artist", id, "code", apiErr.Code)
+				related.Artists = nil
+			}
+		}()
+	}
+	wg.Wait()
+	for _, apiErr := range []*apiError{artistErr, albumsErr, topErr} {
+		if apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+	}
+
+	out := artistResponse{catalogItem: artist.normalize("artist")}
+	out.Albums = albums.normalize("album", offset, limit)
+	uris := make([]string, 0, len(top.Tracks))
+	for _, track := range top.Tracks {
+		if track != nil && track.URI != "" {
+			out.TopTracks = append(out.TopTracks, track.normalize("track"))
+			uris = append(uris, track.URI)
+		}
+	}
+	for i := range out.TopTracks {
+		position := i
+		out.TopTracks[i].Play = playRequest{URIs: uris, Offset: &playOffset{Position: &position}}
+	}
+	for _, other := range related.Artists {
+		if other != nil && other.URI != "" {
+			out.RelatedArtists = append(out.RelatedArtists, other.normalize("artist"))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// getJSON reads a Spotify endpoint into dst.
+func (a *API) getJSON(ctx context.Context, path string, query url.Values, dst any) *apiError {
+	_, body, err := a.Spotify.Do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return spotifyAPIError(err)
+	}
+	if err := json.Unmarshal(body, dst); err != nil {
+		return &apiError{Status: http.StatusBadGateway, Code: codeForStatus(http.StatusBadGateway), Message: "invalid response from Spotify"}
+	}
+	return nil
+}
+
+func pathSpotifyID(r *http.Request) (string, *apiError) {
+	id := r.PathValue("id")
+	if !spotifyIDPattern.MatchString(id) {
+		return "", invalidField("id", "id must be a 22-character Spotify ID")
+	}
+	return id, nil
+}
+
+// parsePage reads the limit and offset parameters.
+func parsePage(values url.Values, defaultLimit, maxOffset int) (int, int, *apiError) {
+	limit, offset := defaultLimit, 0
+	if raw := values.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, invalidField("limit", "limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	if raw := values.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 || n > maxOffset {
+			return 0, 0, invalidField("offset", "offset must be between 0 and %d", maxOffset)
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+func parseMarket(values url.Values) (string, *apiError) {
+	raw := values.Get("market")
+	if raw == "" {
+		return "", nil
+	}
+	market := strings.ToUpper(strings.TrimSpace(raw))
+	if !marketPattern.MatchString(market) {
+		return "", invalidField("market", "market must be an ISO 3166-1 alpha-2 country code")
+	}
+	return market, nil
+}
+
+// requestMarket returns the market parameter, defaulting to the account's
+// country.
+func (a *API) requestMarket(r *http.Request) (string, *apiError) {
+	market, apiErr := parseMarket(r.URL.Query())
+	if apiErr != nil || market != "" {
+		return market, apiErr
+	}
+	return a.profileMarket(r.Context()), nil
+}
+
+func marketQuery(market string) url.Values {
+	query := url.Values{}
+	if market != "" {
+		query.Set("market", market)
+	}
+	return query
+}
+
+// spotifyPage is a page of a Spotify list response.
+type spotifyPage struct {
+	// Items are pointers because Spotify pads some pages with nulls.
+	Items []*spotifyItem `json:"items"`
+	Total int            `json:"total"`
+}
+
+// spotifyItem holds the fields of the catalog objects the normalized model
+// is built from; each type only fills some of them.
+type spotifyItem struct {
+	ID      string            `json:"id"`
+	URI     string            `json:"uri"`
+	Name    string            `json:"name"`
+	Artists []spotifyNamed    `json:"artists"`
+	Authors []spotifyNamed    `json:"authors"`
+	Album   *spotifyAlbumLink `json:"album"`
+	Images  []spotifyImage    `json:"images"`
+	Owner   *struct {
+		DisplayName string `json:"display_name"`
+	} `json:"owner"`
+	Publisher   string `json:"publisher"`
+	DurationMS  int    `json:"duration_ms"`
+	Explicit    bool   `json:"explicit"`
+	Popularity  int    `json:"popularity"`
+	ReleaseDate string `json:"release_date"`
+	TotalTracks int    `json:"total_tracks"`
+	TrackNumber int    `json:"track_number"`
+	DiscNumber  int    `json:"disc_number"`
+	AlbumType   string `json:"album_type"`
+	AlbumGroup  string `json:"album_group"`
+	Tracks      *struct {
+		Total int `json:"total"`
+	} `json:"tracks"`
+	Followers *struct {
+		Total int `json:"total"`
+	} `json:"followers"`
+	Genres     []string `json:"genres"`
+	IsPlayable *bool    `json:"is_playable"`
+}
+
+// spotifyAlbum is a full album, which embeds its first page of tracks.
+type spotifyAlbum struct {
+	spotifyItem
+	Label  string      `json:"label"`
+	Tracks spotifyPage `json:"tracks"`
+}
+
+type spotifyAlbumLink struct {
+	ID     string         `json:"id"`
+	Name   string         `json:"name"`
+	Images []spotifyImage `json:"images"`
+}
+
+type spotifyNamed struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type spotifyImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+func (p spotifyPage) normalize(kind string, offset, limit int) catalogPage {
+	out := catalogPage{Items: []catalogItem{}, Total: p.Total, Offset: offset, Limit: limit}
+	for _, item := range p.Items {
+		if item == nil || item.URI == "" {
+			continue
+		}
+		out.Items = append(out.Items, item.normalize(kind))
+	}
+	if next := offset + limit; next < p.Total {
+		out.NextOffset = &next
+	}
+	return out
+}
+
+func (s spotifyItem) normalize(kind string) catalogItem {
+	item := catalogItem{
+		Type:        kind,
+		ID:          s.ID,
+		URI:         s.URI,
+		Name:        s.Name,
+		DurationMS:  s.DurationMS,
+		Explicit:    s.Explicit,
+		Popularity:  s.Popularity,
+		ReleaseDate: s.ReleaseDate,
+		TotalTracks: s.TotalTracks,
+		TrackNumber: s.TrackNumber,
+		DiscNumber:  s.DiscNumber,
+		Genres:      s.Genres,
+		Artists:     s.Artists,
+		Playable:    s.IsPlayable,
+		ImageURL:    pickImage(s.Images),
+	}
+	switch kind {
+	case "track":
+		item.Subtitle = joinNames(s.Artists)
+		if s.Album != nil {
+			item.Album = &spotifyNamed{ID: s.Album.ID, Name: s.Album.Name}
+			item.ImageURL = pickImage(s.Album.Images)
+		}
+	case "album":
+		item.Subtitle = joinNames(s.Artists)
+		item.Group = s.AlbumGroup
+		if item.Group == "" {
+			item.Group = s.AlbumType
+		}
+	case "playlist":
+		if s.Owner != nil {
+			item.Subtitle = s.Owner.DisplayName
+		}
+		if s.Tracks != nil {
+			item.TotalTracks = s.Tracks.Total
+		}
+	case "show":
+		item.Subtitle = s.Publisher
+	case "audiobook":
+		item.Subtitle = joinNames(s.Authors)
+	}
+	if s.Followers != nil {
+		item.Followers = s.Followers.Total
+	}
+	if containsString(playableTypes, kind) {
+		item.Play = playRequest{URIs: []string{s.URI}}
+		item.Queueable = true
+	} else {
+		item.Play = playRequest{ContextURI: s.URI}
+	}
+	return item
+}
+
+// pickImage returns the smallest image that is still at least 64px wide,
+// which is what result lists show, or the first one when sizes are unknown.
+func pickImage(images []spotifyImage) string {
+	best := -1
+	for i, img := range images {
+		if img.Width < 64 {
+			continue
+		}
+		if best < 0 || img.Width < images[best].Width {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return images[best].URL
+	}
+	if len(images) > 0 {
+		return images[0].URL
+	}
+	return ""
+}
+
+func joinNames(named []spotifyNamed) string {
+	names := make([]string, 0, len(named))
+	for _, n := range named {
+		if n.Name != "" {
+			names = append(names, n.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// marketCache remembers the account's country, which catalog reads use as
+// their market.
+type marketCache struct {
+	mu       sync.Mutex
+	country  string
+	fetched  time.Time
+	failedAt time.Time
+	// flight is closed once the profile read in progress is done.
+	flight chan struct{}
+}
+
+// profileMarket returns the country from the account profile, or "" when
+// it cannot be read; the read then runs without a market. The profile is
+// read by one caller at a time and outside the lock. A stale country is
+// returned right away while it is refreshed; only the first read waits.
+func (a *API) profileMarket(ctx context.Context) string {
+	m := &a.market
+	m.mu.Lock()
+	now := time.Now()
+	if (m.country != "" && now.Sub(m.fetched) < profileMarketTTL) || now.Sub(m.failedAt) < profileRetryAfter {
+		country := m.country
+		m.mu.Unlock()
+		return country
+	}
+	flight := m.flight
+	if flight == nil {
+		flight = make(chan struct{})
+		m.flight = flight
+		go a.fetchMarket(context.WithoutCancel(ctx), flight)
+	}
+	country := m.country
+	m.mu.Unlock()
+	if country != "" {
+		return country
+	}
+
+	select {
+	case <-flight:
+	case <-ctx.Done():
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.country
+}
+
+// fetchMarket reads the profile for profileMarket and closes flight. It is
+// detached from the caller that started it, which may give up first.
+func (a *API) fetchMarket(ctx context.Context, flight chan struct{}) {
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	_, body, err := a.Spotify.Do(ctx, http.MethodGet, "/me", nil, nil)
+	var profile spotifyProfile
+	if err == nil {
+		err = json.Unmarshal(body, &profile)
+	}
+
+	m := &a.market
+	m.mu.Lock()
+	if err != nil || !marketPattern.MatchString(profile.Country) {
+		slog.WarnContext(ctx, "read profile market", "err", err, "country", profile.Country)
+		m.failedAt = time.Now()
+	} else {
+		m.country, m.fetched = profile.Country, time.Now()
+	}
+	m.flight = nil
+	m.mu.Unlock()
+	close(flight)
+}
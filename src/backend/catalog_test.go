@@ -0,0 +1,301 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testAlbumID  = "1DFixLWuPkv3KT3TnV35m3"
+	testArtistID = "0OdUWJ0sBjDrqHygGUXeCF"
+)
+
+// catalogStub serves one album and one artist and records the market of
+// every catalog read.
+type catalogStub struct {
+	mu      sync.Mutex
+	markets map[string]string
+	// noRelated makes related artists unavailable, as for newer apps.
+	noRelated bool
+}
+
+func (s *catalogStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	s.mu.Lock()
+	if s.markets == nil {
+		s.markets = map[string]string{}
+	}
+	s.markets[path] = r.URL.Query().Get("market")
+	s.mu.Unlock()
+
+	track := func(n int) string {
+		return fmt.Sprintf(`{"id":"t%d","uri":"spotify:track:t%d","name":"Track %d","track_number":%d,"artists":[{"id":"a","name":"Artist"}]}`, n, n, n, n)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch path {
+	case "/me":
+		fmt.Fprint(w, `{"id":"user","country":"SE"}`)
+	case "/albums/" + testAlbumID:
+		fmt.Fprintf(w, `{"id":%q,"uri":"spotify:album:%s","name":"Album","label":"Label",`+
+			`"images":[{"url":"https://i.scdn.co/image/a","width":300,"height":300}],`+
+			`"tracks":{"items":[%s,%s,%s,null],"total":60}}`, testAlbumID, testAlbumID, track(1), track(2), track(3))
+	case "/albums/" + testAlbumID + "/tracks":
+		fmt.Fprintf(w, `{"items":[%s],"total":60}`, track(51))
+	case "/artists/" + testArtistID:
+		fmt.Fprintf(w, `{"id":%q,"uri":"spotify:artist:%s","name":"Artist","followers":{"total":10},"genres":["rock"]}`, testArtistID, testArtistID)
+	case "/artists/" + testArtistID + "/albums":
+		fmt.Fprintf(w, `{"items":[{"id":"b","uri":"spotify:album:b","name":"B","album_group":"single"}],"total":1}`)
+	case "/artists/" + testArtistID + "/top-tracks":
+		fmt.Fprintf(w, `{"tracks":[%s,null,%s]}`, track(1), track(2))
+	case "/artists/" + testArtistID + "/related-artists":
+		if s.noRelated {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"status":404,"message":"Not found."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"artists":[{"id":"c","uri":"spotify:artist:c","name":"Other"}]}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"status":404,"message":"Non existing id"}}`)
+	}
+}
+
+func (s *catalogStub) market(path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.markets[path]
+}
+
+func serveCatalog(t *testing.T, stub *catalogStub, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	stubSpotify(t, stub)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	a := NewAPI(spotify, NewPlaybackCache())
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/albums/{id}", a.handleAlbum)
+	mux.HandleFunc("GET /api/artists/{id}", a.handleArtist)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestCatalogRejectsInvalidParameters(t *testing.T) {
+	tests := []struct {
+		target string
+		status int
+		field  string
+	}{
+		{"/api/albums/short", http.StatusBadRequest, "id"},
+		{"/api/albums/" + testAlbumID + "x", http.StatusBadRequest, "id"},
+		{"/api/artists/has-dashes-in-the-id-x", http.StatusBadRequest, "id"},
+		{"/api/albums/" + testAlbumID + "?limit=0", http.StatusBadRequest, "limit"},
+		{"/api/albums/" + testAlbumID + "?limit=51", http.StatusBadRequest, "limit"},
+		{"/api/albums/" + testAlbumID + "?limit=ten", http.StatusBadRequest, "limit"},
+		{"/api/artists/" + testArtistID + "?offset=-1", http.StatusBadRequest, "offset"},
+		{"/api/artists/" + testArtistID + "?offset=10001", http.StatusBadRequest, "offset"},
+		{"/api/albums/" + testAlbumID + "?market=SWE", http.StatusBadRequest, "market"},
+		{"/api/artists/" + testArtistID + "?market=1A", http.StatusBadRequest, "market"},
+		{"/api/albums/0000000000000000000000", http.StatusNotFound, ""},
+		{"/api/artists/0000000000000000000000", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := serveCatalog(t, &catalogStub{}, tt.target)
+		var body apiError
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != tt.status || body.Field != tt.field {
+			t.Errorf("%s: %d %s, want %d for field %q", tt.target, w.Code, w.Body, tt.status, tt.field)
+		}
+	}
+}
+
+func TestAlbumPlaysFromEachTrack(t *testing.T) {
+	tests := []struct {
+		target string
+		market string
+		tracks []string
+		next   *int
+	}{
+		{target: "/api/albums/" + testAlbumID, market: "SE", tracks: []string{"t1", "t2", "t3"}, next: intPtr(50)},
+		{target: "/api/albums/" + testAlbumID + "?limit=2&market=de", market: "DE", tracks: []string{"t1", "t2"}, next: intPtr(2)},
+		{target: "/api/albums/" + testAlbumID + "?offset=50&limit=10", market: "SE", tracks: []string{"t51"}},
+	}
+	for _, tt := range tests {
+		stub := &catalogStub{}
+		w := serveCatalog(t, stub, tt.target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.target, w.Code, w.Body)
+		}
+		var out albumResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		if got := stub.market("/albums/" + testAlbumID); got != tt.market {
+			t.Errorf("%s: market = %q, want %q", tt.target, got, tt.market)
+		}
+		if len(out.Tracks.Items) != len(tt.tracks) {
+			t.Fatalf("%s: %d tracks, want %v", tt.target, len(out.Tracks.Items), tt.tracks)
+		}
+		for i, track := range out.Tracks.Items {
+			if track.ID != tt.tracks[i] {
+				t.Errorf("%s: track %d = %s, want %s", tt.target, i, track.ID, tt.tracks[i])
+			}
+			if track.Play.ContextURI != "spotify:album:"+testAlbumID || track.Play.Offset == nil || track.Play.Offset.URI != track.URI {
+				t.Errorf("%s: track %s play = %+v, want the album from this track", tt.target, track.ID, track.Play)
+			}
+			if track.ImageURL == "" || track.Album == nil || track.Album.ID != testAlbumID {
+				t.Errorf("%s: track %s lacks the album image or link", tt.target, track.ID)
+			}
+		}
+		if (out.Tracks.NextOffset == nil) != (tt.next == nil) || (tt.next != nil && *out.Tracks.NextOffset != *tt.next) {
+			t.Errorf("%s: next_offset = %v, want %v", tt.target, out.Tracks.NextOffset, tt.next)
+		}
+	}
+}
+
+func TestArtistDetail(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		noRelated bool
+		// top and related are the expected counts.
+		top, related int
+	}{
+		{name: "first page", target: "/api/artists/" + testArtistID, top: 2, related: 1},
+		{name: "related artists unavailable", target: "/api/artists/" + testArtistID, noRelated: true, top: 2},
+		{name: "later page", target: "/api/artists/" + testArtistID + "?offset=20"},
+	}
+	for _, tt := range tests {
+		w := serveCatalog(t, &catalogStub{noRelated: tt.noRelated}, tt.target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.name, w.Code, w.Body)
+		}
+		var out artistResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		if len(out.TopTracks) != tt.top || len(out.RelatedArtists) != tt.related {
+			t.Errorf("%s: %d top tracks and %d related, want %d and %d", tt.name, len(out.TopTracks), len(out.RelatedArtists), tt.top, tt.related)
+		}
+		if len(out.Albums.Items) != 1 || out.Albums.Items[0].Group != "single" {
+			t.Errorf("%s: albums = %+v", tt.name, out.Albums.Items)
+		}
+		for i, track := range out.TopTracks {
+			if len(track.Play.URIs) != tt.top || track.Play.Offset == nil || track.Play.Offset.Position == nil || *track.Play.Offset.Position != i {
+				t.Errorf("%s: top track %d play = %+v, want the list from position %d", tt.name, i, track.Play, i)
+			}
+		}
+	}
+}
+
+func intPtr(n int) *int { return &n }
+
+// profileStub answers /me with country, holding each response until gate
+// is closed.
+type profileStub struct {
+	reads   atomic.Int32
+	country atomic.Value
+	gate    chan struct{}
+}
+
+func (s *profileStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.reads.Add(1)
+	<-s.gate
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":"user","country":%q}`, s.country.Load())
+}
+
+func newMarketTestAPI(t *testing.T, stub *profileStub) *API {
+	t.Helper()
+	stubSpotify(t, stub)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	return NewAPI(spotify, NewPlaybackCache())
+}
+
+func TestProfileMarketSharesOneRead(t *testing.T) {
+	stub := &profileStub{gate: make(chan struct{})}
+	stub.country.Store("SE")
+	a := newMarketTestAPI(t, stub)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	markets := make([]string, callers)
+	for i := range markets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			markets[i] = a.profileMarket(context.Background())
+		}()
+	}
+	eventually(t, "profile read to start", func() bool { return stub.reads.Load() == 1 })
+	close(stub.gate)
+	wg.Wait()
+
+	if n := stub.reads.Load(); n != 1 {
+		t.Fatalf("profile reads = %d, want 1 for %d callers", n, callers)
+	}
+	for i, market := range markets {
+		if market != "SE" {
+			t.Errorf("caller %d market = %q, want SE", i, market)
+		}
+	}
+}
+
+func TestProfileMarketCallerGivesUp(t *testing.T) {
+	stub := &profileStub{gate: make(chan struct{})}
+	stub.country.Store("SE")
+	a := newMarketTestAPI(t, stub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if market := a.profileMarket(ctx); market != "" {
+		t.Fatalf("market = %q, want none while the profile read is stuck", market)
+	}
+	// The lock is not held during the read, so others are not blocked.
+	done := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		a.profileMarket(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("profileMarket blocked behind the read in flight")
+	}
+
+	close(stub.gate)
+	eventually(t, "profile read to finish", func() bool {
+		a.market.mu.Lock()
+		defer a.market.mu.Unlock()
+		return a.market.flight == nil
+	})
+}
+
+func TestProfileMarketServesStaleWhileRefreshing(t *testing.T) {
+	stub := &profileStub{gate: make(chan struct{})}
+	stub.country.Store("DE")
+	a := newMarketTestAPI(t, stub)
+	a.market.country = "SE"
+	a.market.fetched = time.Now().Add(-2 * profileMarketTTL)
+
+	if market := a.profileMarket(context.Background()); market != "SE" {
+		t.Fatalf("market = %q, want the stale SE while refreshing", market)
+	}
+	close(stub.gate)
+	eventually(t, "refreshed market", func() bool {
+		a.market.mu.Lock()
+		defer a.market.mu.Unlock()
+		return a.market.country == "DE"
+	})
+}
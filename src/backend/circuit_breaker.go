@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// BreakerStatus describes one endpoint family's circuit breaker.
+type BreakerStatus struct {
+	Family   string     `json:"family"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+// breakers holds one circuit breaker per endpoint family, so an outage of
+// e.g. search does not block playback control.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+	// now is the clock; tests replace it.
+	now func() time.Time
+
+	mu       sync.Mutex
+	families map[string]*breaker
+}
+
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+	retryAt  time.Time
+	// probing is set while the single half-open trial request runs.
+	probing bool
+}
+
+type breakerOutcome int
+
+const (
+	outcomeIgnored breakerOutcome = iota
+	outcomeSuccess
+	outcomeFailure
+)
+
+func newBreakersFromEnv() *breakers {
+	threshold := GetenvInt("SPOTIFY_BREAKER_FAILURES", 5)
+	if threshold < 1 {
+		threshold = 5
+	}
+	cooldown := GetenvDuration("SPOTIFY_BREAKER_COOLDOWN", 30*time.Second)
+	return &breakers{threshold: threshold, cooldown: cooldown, now: time.Now, families: map[string]*breaker{}}
+}
+
+// endpointFamily groups Web API paths that share a backend at Spotify.
+func endpointFamily(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/me/player"):
+		return "player"
+	case strings.HasPrefix(path, "/search"):
+		return "search"
+	case path == "/me" || strings.HasPrefix(path, "/me/"):
+		return "profile"
+	}
+	return "catalog"
+}
+
+// allow reports whether a request to family may proceed. While the breaker
+// is open it returns a circuit_open error without calling Spotify; once the
+// cooldown has passed a single trial request is let through.
+func (b *breakers) allow(family string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.get(family)
+	switch br.state {
+	case BreakerOpen:
+		if now := b.clock(); now.Before(br.retryAt) {
+			return circuitOpenError(family, br.retryAt.Sub(now))
+		}
+		br.state = BreakerHalfOpen
+		br.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if br.probing {
+			return circuitOpenError(family, time.Second)
+		}
+		br.probing = true
+	}
+	return nil
+}
+
+func (b *breakers) record(family string, outcome breakerOutcome) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.get(family)
+	halfOpen := br.state == BreakerHalfOpen
+	br.probing = false
+	switch outcome {
+	case outcomeSuccess:
+		br.state = BreakerClosed
+		br.failures = 0
+		br.openedAt, br.retryAt = time.Time{}, time.Time{}
+	case outcomeFailure:
+		br.failures++
+		if halfOpen || br.failures >= b.threshold {
+			now := b.clock()
+			br.state = BreakerOpen
+			br.openedAt = now
+			br.retryAt = now.Add(b.cooldown)
+		}
+	}
+}
+
+func (b *breakers) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func (b *breakers) get(family string) *breaker {
+	br, ok := b.families[family]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.families[family] = br
+	}
+	return br
+}
+
+func (b *breakers) status() []BreakerStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]BreakerStatus, 0, len(b.families))
+	for _, family := range []string{"player", "search", "profile", "catalog"} {
+		br, ok := b.families[family]
+		if !ok {
+			continue
+		}
+		st := BreakerStatus{Family: family, State: br.state, Failures: br.failures}
+		if !br.openedAt.IsZero() {
+			opened, retry := br.openedAt, br.retryAt
+			st.OpenedAt, st.RetryAt = &opened, &retry
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// breakerOutcomeFor classifies a Web API result. Only signs that Spotify
+// itself is failing count against the breaker; a caller hanging up does not.
+func breakerOutcomeFor(ctx context.Context, err error) breakerOutcome {
+	if err == nil {
+		return outcomeSuccess
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return outcomeIgnored
+	}
+	if errors.Is(err, context.DeadlineExceeded) || hasSpotifyCode(err, codeUpstreamUnavailable) {
+		return outcomeFailure
+	}
+	if _, ok := asSpotifyError(err); ok {
+		// Spotify answered; the API is up even if the call was refused.
+		return outcomeSuccess
+	}
+	return outcomeIgnored
+}
+
+func circuitOpenError(family string, retryAfter time.Duration) *SpotifyError {
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return &SpotifyError{
+		Code:       codeCircuitOpen,
+		Message:    "Spotify is failing; " + family + " requests are paused",
+		Status:     http.StatusServiceUnavailable,
+		Retryable:  true,
+		RetryAfter: retryAfter,
+	}
+}
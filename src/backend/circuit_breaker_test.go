@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for the breakers.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestBreakerTransitions(t *testing.T) {
+	const (
+		allow   = "allow"
+		success = "success"
+		failure = "failure"
+		ignored = "ignored"
+		wait    = "wait"
+	)
+	type step struct {
+		op string
+		// d is how far wait advances the clock.
+		d time.Duration
+		// blocked is whether allow must refuse with circuit_open.
+		blocked bool
+		// state is the breaker state after the step.
+		state string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "failures below the threshold keep it closed",
+			steps: []step{
+				{op: allow, state: BreakerClosed},
+				{op: failure, state: BreakerClosed},
+				{op: allow, state: BreakerClosed},
+				{op: failure, state: BreakerClosed},
+				{op: allow, state: BreakerClosed},
+				{op: success, state: BreakerClosed},
+				// The success reset the count.
+				{op: allow, state: BreakerClosed},
+				{op: failure, state: BreakerClosed},
+				{op: allow, state: BreakerClosed},
+				{op: failure, state: BreakerClosed},
+			},
+		},
+		{
+			name: "closed to open to half-open to closed",
+			steps: []step{
+				{op: failure, state: BreakerClosed},
+				{op: failure, state: BreakerClosed},
+				{op: failure, state: BreakerOpen},
+				{op: allow, blocked: true, state: BreakerOpen},
+				{op: wait, d: 9 * time.Second, state: BreakerOpen},
+				{op: allow, blocked: true, state: BreakerOpen},
+				{op: wait, d: time.Second, state: BreakerOpen},
+				{op: allow, state: BreakerHalfOpen},
+				{op: success, state: BreakerClosed},
+				{op: allow, state: BreakerClosed},
+			},
+		},
+		{
+			name: "half-open lets a single probe through",
+			steps: []step{
+				{op: failure}, {op: failure}, {op: failure, state: BreakerOpen},
+				{op: wait, d: 10 * time.Second, state: BreakerOpen},
+				{op: allow, state: BreakerHalfOpen},
+				{op: allow, blocked: true, state: BreakerHalfOpen},
+				{op: allow, blocked: true, state: BreakerHalfOpen},
+				{op: success, state: BreakerClosed},
+				{op: allow, state: BreakerClosed},
+				{op: allow, state: BreakerClosed},
+			},
+		},
+		{
+			name: "failed probe reopens for a full cooldown",
+			steps: []step{
+				{op: failure}, {op: failure}, {op: failure, state: BreakerOpen},
+				{op: wait, d: 10 * time.Second, state: BreakerOpen},
+				{op: allow, state: BreakerHalfOpen},
+				{op: failure, state: BreakerOpen},
+				{op: allow, blocked: true, state: BreakerOpen},
+				{op: wait, d: 9 * time.Second, state: BreakerOpen},
+				{op: allow, blocked: true, state: BreakerOpen},
+				{op: wait, d: time.Second, state: BreakerOpen},
+				{op: allow, state: BreakerHalfOpen},
+				{op: success, state: BreakerClosed},
+			},
+		},
+		{
+			name: "ignored probe frees the slot for another",
+			steps: []step{
+				{op: failure}, {op: failure}, {op: failure, state: BreakerOpen},
+				{op: wait, d: 10 * time.Second, state: BreakerOpen},
+				{op: allow, state: BreakerHalfOpen},
+				{op: ignored, state: BreakerHalfOpen},
+				{op: allow, state: BreakerHalfOpen},
+				{op: allow, blocked: true, state: BreakerHalfOpen},
+				{op: success, state: BreakerClosed},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+			b := &breakers{threshold: 3, cooldown: 10 * time.Second, now: clock.now, families: map[string]*breaker{}}
+			for i, s := range tt.steps {
+				switch s.op {
+				case allow:
+					err := b.allow("player")
+					if blocked := hasSpotifyCode(err, codeCircuitOpen); blocked != s.blocked {
+						t.Fatalf("step %d: allow err = %v, want blocked=%v", i, err, s.blocked)
+					}
+				case success:
+					b.record("player", outcomeSuccess)
+				case failure:
+					b.record("player", outcomeFailure)
+				case ignored:
+					b.record("player", outcomeIgnored)
+				case wait:
+					clock.advance(s.d)
+				}
+				if s.state == "" {
+					continue
+				}
+				if got := b.families["player"].state; got != s.state {
+					t.Fatalf("step %d (%s): state = %s, want %s", i, s.op, got, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerFamiliesAreIndependent(t *testing.T) {
+	b := &breakers{threshold: 1, cooldown: time.Minute, families: map[string]*breaker{}}
+	b.record("search", outcomeFailure)
+	if err := b.allow("search"); !hasSpotifyCode(err, codeCircuitOpen) {
+		t.Fatalf("search allow = %v, want circuit_open", err)
+	}
+	if err := b.allow("player"); err != nil {
+		t.Fatalf("player allow = %v, want nil", err)
+	}
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	b := &breakers{threshold: 1, cooldown: 30 * time.Second, now: clock.now, families: map[string]*breaker{}}
+	b.record("player", outcomeFailure)
+	clock.advance(12 * time.Second)
+	err := b.allow("player")
+	spErr, ok := asSpotifyError(err)
+	if !ok || spErr.RetryAfter != 18*time.Second {
+		t.Fatalf("allow = %v, want circuit_open retrying after 18s", err)
+	}
+}
+
+func TestBreakerOutcomeFor(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want breakerOutcome
+	}{
+		{"success", context.Background(), nil, outcomeSuccess},
+		{"upstream 5xx", context.Background(), &SpotifyError{Code: codeUpstreamUnavailable}, outcomeFailure},
+		{"timeout", context.Background(), context.DeadlineExceeded, outcomeFailure},
+		{"refused by Spotify", context.Background(), &SpotifyError{Code: codeRestrictionViolated}, outcomeSuccess},
+		{"caller hung up", cancelled, &SpotifyError{Code: codeUpstreamUnavailable}, outcomeIgnored},
+		{"transport error", context.Background(), errors.New("connection reset"), outcomeIgnored},
+	}
+	for _, tt := range tests {
+		if got := breakerOutcomeFor(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: outcome = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"context"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/homenavi/spotify-integration/internal/clientip"
+	"github.com/homenavi/spotify-integration/internal/idempotency"
+	"github.com/homenavi/spotify-integration/internal/logging"
 	"github.com/homenavi/spotify-integration/internal/ratelimit"
+	"github.com/homenavi/spotify-integration/internal/requestid"
 	"github.com/homenavi/spotify-integration/internal/security"
+	"github.com/homenavi/spotify-integration/internal/tracing"
 	"github.com/homenavi/spotify-integration/src/backend"
 )
 
 func main() {
+	logger := logging.FromEnv(os.Stderr)
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8099"
@@ -26,13 +41,20 @@ func main() {
 	manifestPath = filepath.Clean(manifestPath)
 	manifestJSON, err := os.ReadFile(manifestPath) // #nosec G304 -- path comes from env/config
 	if err != nil {
-		log.Fatalf("read manifest: %v", err)
+		fatal("read manifest", err)
 	}
 	secretSpecs := backend.ParseSecretSpecs(manifestJSON)
+	shutdownTracing, err := tracing.Setup(ctx, backend.ManifestVersion(manifestJSON))
+	if err != nil {
+		fatal("set up tracing", err)
+	}
+	if tracing.Enabled() {
+		slog.Info("tracing enabled")
+	}
 	secretStore := backend.NewSecretStore(backend.DefaultSecretsPath())
 	adminAuth, err := backend.NewAdminAuthFromEnv()
 	if err != nil {
-		log.Fatalf("load admin auth: %v", err)
+		fatal("load admin auth", err)
 	}
 
 	webDir := os.Getenv("WEB_DIR")
@@ -42,31 +64,87 @@ func main() {
 	webDir = filepath.Clean(webDir)
 	webFS := os.DirFS(webDir)
 	if _, err := fs.Stat(webFS, "."); err != nil {
-		log.Fatalf("web dir error: %v", err)
+		fatal("web dir error", err)
 	}
 
-	spotifyClient, err := backend.NewSpotifyClientFromEnv()
+	spotifyClient, err := backend.NewSpotifyClientFromEnv(secretStore)
 	if err != nil {
-		log.Printf("spotify config missing: %v", err)
+		slog.Warn("spotify config missing", "err", err)
 		spotifyClient = nil
 	}
 
+	playback := backend.NewPlaybackCache()
+	mutes := backend.NewMuteMemory()
+	state := backend.NewStateStoreFromEnv()
+	if err := state.Load(playback, spotifyClient, mutes); err != nil {
+		slog.Warn("load state", "err", err)
+	}
+	mutes.OnChange = func() {
+		if err := state.Save(playback, spotifyClient, mutes); err != nil {
+			slog.Error("save state", "err", err)
+		}
+	}
+
+	// Background workers stop when ctx is cancelled and are waited for
+	// before the state is saved.
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		spotifyClient.Run(ctx)
+	}()
+
 	s := &backend.Server{
 		WebFS:        webFS,
 		ManifestJSON: manifestJSON,
 		Spotify:      spotifyClient,
-		Playback:     backend.NewPlaybackCache(),
+		Playback:     playback,
+		Mutes:        mutes,
 		SecretStore:  secretStore,
 		SecretSpecs:  secretSpecs,
 		AdminAuth:    adminAuth,
+		Audit:        backend.NewAuditLogFromEnv(),
+		Images:       backend.NewImageProxyFromEnv(),
 	}
 	h := s.Routes()
 
-	h = ratelimit.NewIPRateLimiter(10, 20)(h)
-	h = security.SecurityHeaders(h)
+	trustedProxies, err := clientip.ParseTrusted(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		fatal("parse TRUSTED_PROXIES", err)
+	}
+	routeLimits, err := ratelimit.ParseRoutes(backend.Getenv("RATE_LIMIT_ROUTES", "/api/volume=2:4,/api/seek=2:4,/api/state=20:40,/api/image=20:60"))
+	if err != nil {
+		fatal("parse RATE_LIMIT_ROUTES", err)
+	}
+
+	h = idempotency.New(idempotency.Config{
+		TTL:      backend.GetenvDuration("IDEMPOTENCY_TTL", time.Hour),
+		MaxKeys:  backend.GetenvInt("IDEMPOTENCY_MAX_KEYS", 1000),
+		Identity: adminAuth.Subject,
+	})(h)
+	h = ratelimit.New(ratelimit.Config{
+		Default: ratelimit.Limit{
+			RPS:   backend.GetenvFloat("RATE_LIMIT_RPS", 10),
+			Burst: backend.GetenvFloat("RATE_LIMIT_BURST", 20),
+		},
+		Routes:   routeLimits,
+		Identity: adminAuth.Subject,
+	})(h)
+	h = security.CSRF(security.CSRFConfig{
+		TrustedOrigins: security.ParseOrigins(os.Getenv("CSRF_TRUSTED_ORIGINS")),
+	})(h)
+	csp, err := security.BuildCSP(os.Getenv("CSP_DIRECTIVES"))
+	if err != nil {
+		fatal("parse CSP_DIRECTIVES", err)
+	}
+	h = security.WithSecurityHeaders(csp)(h)
+	h = logging.AccessLog(logger)(h)
+	h = clientip.Middleware(trustedProxies)(h)
+	h = requestid.Middleware(h)
+	h = tracing.Middleware(h)
 
 	addr := ":" + port
-	log.Printf("spotify integration listening on %s", addr)
+	slog.Info("spotify integration listening", "addr", addr)
 	server := &http.Server{
 		Addr:              addr,
 		Handler:           h,
@@ -74,8 +152,40 @@ func main() {
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      15 * time.Second,
 		IdleTimeout:       60 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 	}
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			fatal("listen", err)
+		}
+	case <-ctx.Done():
 	}
+	stop()
+
+	timeout := backend.GetenvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	slog.Info("shutting down", "drain_timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("shutdown", "err", err)
+	}
+	workers.Wait()
+	if err := state.Save(playback, spotifyClient, mutes); err != nil {
+		slog.Error("save state", "err", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("flush traces", "err", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
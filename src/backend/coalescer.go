@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// coalesceSendTimeout bounds one upstream call made on behalf of a burst. It
+// is detached from the callers, any of whom may give up first.
+const coalesceSendTimeout = commandTimeout
+
+// coalescer merges bursts of volume and seek commands, such as those fired
+// while dragging a slider. Per device and command kind it keeps only the
+// latest pending value, sends at most one upstream call per interval and
+// answers every superseded request with the result of the value actually
+// sent.
+type coalescer struct {
+	spotify  *SpotifyClient
+	queue    *commandQueue
+	interval time.Duration
+
+	mu    sync.Mutex
+	slots map[string]*coalesceSlot
+}
+
+type coalesceSlot struct {
+	pending  *playerCommand
+	ctx      context.Context
+	waiters  []chan commandResult
+	lastSent time.Time
+}
+
+func newCoalescerFromEnv(spotify *SpotifyClient, queue *commandQueue) *coalescer {
+	return &coalescer{
+		spotify:  spotify,
+		queue:    queue,
+		interval: GetenvDuration("SPOTIFY_COALESCE_INTERVAL", 250*time.Millisecond),
+		slots:    map[string]*coalesceSlot{},
+	}
+}
+
+// submit queues cmd as the latest value for its device and kind, and waits
+// for the upstream call that carries it or a later value.
+func (c *coalescer) submit(ctx context.Context, cmd playerCommand) commandResult {
+	key := cmd.coalesce + "|" + cmd.deviceID
+	done := make(chan commandResult, 1)
+
+	c.mu.Lock()
+	slot, ok := c.slots[key]
+	if !ok {
+		// A slot lives as long as its flush goroutine.
+		slot = &coalesceSlot{}
+		c.slots[key] = slot
+		go c.flush(key, slot)
+	}
+	slot.pending = &cmd
+	slot.ctx = context.WithoutCancel(ctx)
+	slot.waiters = append(slot.waiters, done)
+	c.mu.Unlock()
+
+	select {
+	case res := <-done:
+		return res
+	case <-ctx.Done():
+		return commandResult{cmd: cmd, err: ctx.Err()}
+	}
+}
+
+// flush sends the slot's pending value whenever the interval since the last
+// send has passed. It exits once nothing has been pending for a whole
+// interval.
+func (c *coalescer) flush(key string, slot *coalesceSlot) {
+	for {
+		c.mu.Lock()
+		wait := c.interval - time.Since(slot.lastSent)
+		if slot.pending == nil && wait <= 0 {
+			delete(c.slots, key)
+			c.mu.Unlock()
+			return
+		}
+		if wait > 0 {
+			c.mu.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+		cmd, parent, waiters := *slot.pending, slot.ctx, slot.waiters
+		slot.pending, slot.ctx, slot.waiters = nil, nil, nil
+		slot.lastSent = time.Now()
+		c.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(parent, coalesceSendTimeout)
+		res := sendCommand(ctx, c.spotify, c.queue, cmd)
+		cancel()
+		res.merged = len(waiters)
+		for _, w := range waiters {
+			w <- res
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// volumePlayer is a Spotify stub that records every volume it is sent.
+// While gate is non-nil, calls block until it is closed.
+type volumePlayer struct {
+	mu      sync.Mutex
+	volumes []int
+	gate    chan struct{}
+}
+
+func (p *volumePlayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v, _ := strconv.Atoi(r.URL.Query().Get("volume_percent"))
+	p.mu.Lock()
+	p.volumes = append(p.volumes, v)
+	gate := p.gate
+	p.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *volumePlayer) recorded() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.volumes...)
+}
+
+func newTestCoalescer(t *testing.T, player http.Handler) *coalescer {
+	t.Helper()
+	stubSpotify(t, player)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	return &coalescer{
+		spotify:  spotify,
+		queue:    &commandQueue{depth: 16, timeout: 5 * time.Second},
+		interval: 20 * time.Millisecond,
+		slots:    map[string]*coalesceSlot{},
+	}
+}
+
+func (c *coalescer) waiting(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot, ok := c.slots[key]; ok {
+		return len(slot.waiters)
+	}
+	return 0
+}
+
+func (c *coalescer) slotCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.slots)
+}
+
+func TestCoalescerLastWriteWins(t *testing.T) {
+	player := &volumePlayer{gate: make(chan struct{})}
+	c := newTestCoalescer(t, player)
+
+	var wg sync.WaitGroup
+	results := map[int]commandResult{}
+	var mu sync.Mutex
+	submit := func(v int) {
+		defer wg.Done()
+		res := c.submit(context.Background(), volumeCommand(v, "dev1"))
+		mu.Lock()
+		results[v] = res
+		mu.Unlock()
+	}
+
+	// The first value goes out at once and blocks upstream; the burst
+	// behind it collapses into one call.
+	wg.Add(1)
+	go submit(10)
+	eventually(t, "first volume to be sent", func() bool { return len(player.recorded()) == 1 })
+	for i, v := range []int{20, 30, 40} {
+		wg.Add(1)
+		go submit(v)
+		eventually(t, "burst to queue", func() bool { return c.waiting("volume|dev1") == i+1 })
+	}
+	close(player.gate)
+	wg.Wait()
+
+	got := player.recorded()
+	if len(got) != 2 || got[0] != 10 || got[1] != 40 {
+		t.Fatalf("volumes sent = %v, want [10 40]", got)
+	}
+	if res := results[10]; res.err != nil || res.merged != 1 {
+		t.Errorf("first result = %+v, want a single successful call", res)
+	}
+	for _, v := range []int{20, 30, 40} {
+		res := results[v]
+		if res.err != nil {
+			t.Errorf("volume %d: %v", v, res.err)
+		}
+		if res.merged != 3 {
+			t.Errorf("volume %d merged = %d, want 3", v, res.merged)
+		}
+		if sent := res.cmd.query.Get("volume_percent"); sent != "40" {
+			t.Errorf("volume %d answered with the call for %s, want 40", v, sent)
+		}
+	}
+	eventually(t, "idle slot to be dropped", func() bool { return c.slotCount() == 0 })
+}
+
+func TestCoalescerKeepsDevicesApart(t *testing.T) {
+	player := &volumePlayer{}
+	c := newTestCoalescer(t, player)
+
+	var wg sync.WaitGroup
+	for _, dev := range []string{"dev1", "dev2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := c.submit(context.Background(), volumeCommand(25, dev)); res.err != nil || res.merged != 1 {
+				t.Errorf("%s result = %+v", dev, res)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := player.recorded(); len(got) != 2 {
+		t.Fatalf("volumes sent = %v, want one call per device", got)
+	}
+}
+
+func TestCoalescerCancelledCallerStillSends(t *testing.T) {
+	player := &volumePlayer{gate: make(chan struct{})}
+	c := newTestCoalescer(t, player)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan commandResult, 1)
+	go func() { done <- c.submit(ctx, volumeCommand(60, "dev1")) }()
+	eventually(t, "volume to be sent", func() bool { return len(player.recorded()) == 1 })
+
+	cancel()
+	select {
+	case res := <-done:
+		if !errors.Is(res.err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("submit did not return after its context was cancelled")
+	}
+
+	// The upstream call is detached from the caller and completes anyway;
+	// later values still get through.
+	close(player.gate)
+	if res := c.submit(context.Background(), volumeCommand(70, "dev1")); res.err != nil {
+		t.Fatalf("later submit: %v", res.err)
+	}
+	if got := player.recorded(); len(got) != 2 || got[1] != 70 {
+		t.Fatalf("volumes sent = %v, want [60 70]", got)
+	}
+}
+
+func TestCoalescerPacesCalls(t *testing.T) {
+	player := &volumePlayer{}
+	c := newTestCoalescer(t, player)
+	c.interval = 50 * time.Millisecond
+
+	start := time.Now()
+	if res := c.submit(context.Background(), volumeCommand(10, "dev1")); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res := c.submit(context.Background(), volumeCommand(20, "dev1")); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if elapsed := time.Since(start); elapsed < c.interval {
+		t.Fatalf("second call went out after %v, want at least the %v interval", elapsed, c.interval)
+	}
+}
+
+func TestMuteIsNotCoalesced(t *testing.T) {
+	player := &volumePlayer{gate: make(chan struct{})}
+	c := newTestCoalescer(t, player)
+	a := &API{Spotify: c.spotify, Playback: NewPlaybackCache(), Mutes: NewMuteMemory(), queue: c.queue, coalescer: c}
+
+	var wg sync.WaitGroup
+	send := func(cmd playerCommand) {
+		defer wg.Done()
+		if res := a.send(context.Background(), cmd); res.err != nil {
+			t.Errorf("%s: %v", cmd.name, res.err)
+		}
+	}
+	wg.Add(1)
+	go send(volumeCommand(10, "dev1"))
+	eventually(t, "first volume to be sent", func() bool { return len(player.recorded()) == 1 })
+
+	// A mute followed by a volume change must not be merged into it: the
+	// remembered volume is only kept for a mute Spotify actually got.
+	var muted bool
+	mute := muteVolumeCommand("mute", 0, "dev1", true)
+	mute.onSuccess = func() { muted = true }
+	wg.Add(2)
+	go send(mute)
+	go send(volumeCommand(40, "dev1"))
+	eventually(t, "volume to queue", func() bool { return c.waiting("volume|dev1") == 1 })
+	close(player.gate)
+	wg.Wait()
+
+	got := player.recorded()
+	if len(got) != 3 || !slices.Contains(got, 0) {
+		t.Fatalf("volumes sent = %v, want the mute sent on its own", got)
+	}
+	if !muted {
+		t.Error("mute succeeded but its onSuccess did not run")
+	}
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// commandQueue serializes mutating Spotify calls for the account in arrival
+// order, so e.g. next and previous pressed on two panels at once always land
+// in the order they were received. Reads do not go through it.
+type commandQueue struct {
+	depth   int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending int
+	// tail is closed when the most recently queued command finishes.
+	tail chan struct{}
+}
+
+// queueStats describes how a command went through the queue.
+type queueStats struct {
+	// position is how many commands were ahead on arrival.
+	position int
+	waited   time.Duration
+	ran      time.Duration
+}
+
+func newCommandQueueFromEnv() *commandQueue {
+	depth := GetenvInt("COMMAND_QUEUE_DEPTH", 16)
+	if depth < 1 {
+		depth = 16
+	}
+	return &commandQueue{
+		depth:   depth,
+		timeout: GetenvDuration("COMMAND_QUEUE_TIMEOUT", 5*time.Second),
+	}
+}
+
+// run waits for the commands ahead, then calls fn with a context bounded by
+// the queue's per-command timeout. It fails with queue_full when depth
+// commands are already queued, or with ctx's error if ctx ends first.
+func (q *commandQueue) run(ctx context.Context, fn func(context.Context)) (queueStats, error) {
+	if q == nil {
+		start := time.Now()
+		fn(ctx)
+		return queueStats{ran: time.Since(start)}, nil
+	}
+	arrived := time.Now()
+	q.mu.Lock()
+	if q.pending >= q.depth {
+		q.mu.Unlock()
+		return queueStats{position: q.depth}, queueFullError()
+	}
+	stats := queueStats{position: q.pending}
+	q.pending++
+	prev, done := q.tail, make(chan struct{})
+	q.tail = done
+	q.mu.Unlock()
+
+	finish := func() {
+		q.mu.Lock()
+		q.pending--
+		q.mu.Unlock()
+		close(done)
+	}
+
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			// Keep the order for the commands behind this one.
+			go func() {
+				<-prev
+				finish()
+			}()
+			stats.waited = time.Since(arrived)
+			return stats, ctx.Err()
+		}
+	}
+	defer finish()
+
+	stats.waited = time.Since(arrived)
+	runCtx, cancel := context.WithTimeout(ctx, q.timeout)
+	defer cancel()
+	start := time.Now()
+	fn(runCtx)
+	stats.ran = time.Since(start)
+	return stats, nil
+}
+
+func queueFullError() *SpotifyError {
+	return &SpotifyError{
+		Code:       codeQueueFull,
+		Message:    "too many player commands are waiting",
+		Status:     http.StatusServiceUnavailable,
+		Retryable:  true,
+		RetryAfter: time.Second,
+	}
+}
@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPlayer is a Spotify stub that records the n query parameter of
+// every player call. While gate is non-nil, calls block until it is closed.
+type recordingPlayer struct {
+	mu    sync.Mutex
+	calls []string
+	gate  chan struct{}
+}
+
+func (p *recordingPlayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.calls = append(p.calls, r.URL.Query().Get("n"))
+	gate := p.gate
+	p.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *recordingPlayer) recorded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.calls...)
+}
+
+func numberedCommand(n string) playerCommand {
+	return playerCommand{
+		name:   "next",
+		method: http.MethodPost,
+		path:   "/me/player/next",
+		query:  url.Values{"n": {n}},
+	}
+}
+
+func (q *commandQueue) pendingCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func TestCommandQueueKeepsArrivalOrder(t *testing.T) {
+	player := &recordingPlayer{gate: make(chan struct{})}
+	stubSpotify(t, player)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	q := &commandQueue{depth: 16, timeout: 5 * time.Second}
+
+	order := []string{"1", "2", "3", "4", "5"}
+	results := make([]commandResult, len(order))
+	var wg sync.WaitGroup
+	for i, n := range order {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = sendCommand(context.Background(), spotify, q, numberedCommand(n))
+		}()
+		// Queue the next command only once this one has arrived.
+		eventually(t, "command "+n+" to queue", func() bool { return q.pendingCount() == i+1 })
+	}
+	if got := player.recorded(); len(got) != 1 {
+		t.Fatalf("calls while the first is running = %q, want only the first", got)
+	}
+	close(player.gate)
+	wg.Wait()
+
+	got := player.recorded()
+	if len(got) != len(order) {
+		t.Fatalf("calls = %q, want %q", got, order)
+	}
+	for i := range order {
+		if got[i] != order[i] {
+			t.Fatalf("calls = %q, want %q", got, order)
+		}
+		if results[i].err != nil {
+			t.Errorf("command %s: %v", order[i], results[i].err)
+		}
+		if results[i].queue.position != i {
+			t.Errorf("command %s position = %d, want %d", order[i], results[i].queue.position, i)
+		}
+	}
+	if q.pendingCount() != 0 {
+		t.Errorf("pending = %d after all commands finished", q.pendingCount())
+	}
+}
+
+func TestCommandQueueRejectsWhenFull(t *testing.T) {
+	player := &recordingPlayer{gate: make(chan struct{})}
+	stubSpotify(t, player)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	q := &commandQueue{depth: 2, timeout: 5 * time.Second}
+
+	var wg sync.WaitGroup
+	for i, n := range []string{"1", "2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendCommand(context.Background(), spotify, q, numberedCommand(n))
+		}()
+		eventually(t, "command "+n+" to queue", func() bool { return q.pendingCount() == i+1 })
+	}
+
+	res := sendCommand(context.Background(), spotify, q, numberedCommand("3"))
+	if !hasSpotifyCode(res.err, codeQueueFull) {
+		t.Fatalf("err = %v, want %s", res.err, codeQueueFull)
+	}
+	close(player.gate)
+	wg.Wait()
+	if got := player.recorded(); len(got) != 2 {
+		t.Fatalf("calls = %q, want the two queued commands", got)
+	}
+}
+
+func TestCommandQueueCancelledWaiterKeepsOrder(t *testing.T) {
+	player := &recordingPlayer{gate: make(chan struct{})}
+	stubSpotify(t, player)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	q := &commandQueue{depth: 16, timeout: 5 * time.Second}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sendCommand(context.Background(), spotify, q, numberedCommand("1"))
+	}()
+	eventually(t, "first command to run", func() bool { return len(player.recorded()) == 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan commandResult, 1)
+	go func() {
+		cancelled <- sendCommand(ctx, spotify, q, numberedCommand("2"))
+	}()
+	eventually(t, "second command to queue", func() bool { return q.pendingCount() == 2 })
+
+	wg.Add(1)
+	var third commandResult
+	go func() {
+		defer wg.Done()
+		third = sendCommand(context.Background(), spotify, q, numberedCommand("3"))
+	}()
+	eventually(t, "third command to queue", func() bool { return q.pendingCount() == 3 })
+
+	cancel()
+	res := <-cancelled
+	if !errors.Is(res.err, context.Canceled) {
+		t.Fatalf("cancelled command err = %v, want context.Canceled", res.err)
+	}
+	// The third command must still wait for the first.
+	time.Sleep(20 * time.Millisecond)
+	if got := player.recorded(); len(got) != 1 {
+		t.Fatalf("calls before the first finished = %q", got)
+	}
+
+	close(player.gate)
+	wg.Wait()
+	if third.err != nil {
+		t.Fatalf("third command: %v", third.err)
+	}
+	got := player.recorded()
+	if len(got) != 2 || got[0] != "1" || got[1] != "3" {
+		t.Fatalf("calls = %q, want [1 3]", got)
+	}
+	eventually(t, "queue to drain", func() bool { return q.pendingCount() == 0 })
+}
+
+func TestCommandQueueBoundsEachCommand(t *testing.T) {
+	q := &commandQueue{depth: 1, timeout: 10 * time.Millisecond}
+	var deadline time.Time
+	_, err := q.run(context.Background(), func(ctx context.Context) {
+		deadline, _ = ctx.Deadline()
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if deadline.IsZero() || time.Until(deadline) > 10*time.Millisecond {
+		t.Fatalf("command context deadline = %v, want within the queue timeout", deadline)
+	}
+}
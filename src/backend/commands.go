@@ -0,0 +1,464 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// playerCommand is one control action: the Spotify call it makes and the
+// effect it is known to have on the playback state.
+type playerCommand struct {
+	name   string
+	method string
+	path   string
+	query  url.Values
+	body   any
+	// deviceID is the target device, or "" for the active one.
+	deviceID string
+	// effects are projected onto the cached playback state once Spotify
+	// accepts the command.
+	effects []stateEffect
+	// confirm, when set, decides ?wait=confirm from the state before and
+	// after the command instead of from effects.
+	confirm confirmCheck
+	// coalesce names the kind of value a burst of these commands is merged
+	// on; the latest one wins.
+	coalesce string
+	// applied is the value the command sets, returned when no playback state
+	// is cached to project it onto.
+	applied map[string]any
+	// relative, when set, builds the actual command from the current
+	// playback state, e.g. for a volume step.
+	relative func(relativeContext) (playerCommand, *apiError)
+	// anyDevice lets a relative command target a device that is not active;
+	// see targetCommand.
+	anyDevice bool
+	// onSuccess, when set, runs once Spotify has accepted the command.
+	onSuccess func()
+	// activates marks a command that makes deviceID the active device; the
+	// rest of the device object is projected when it is already known.
+	activates bool
+}
+
+// noop reports whether the command needs no Spotify call, e.g. unmute on a
+// device that is not muted.
+func (cmd playerCommand) noop() bool {
+	return cmd.method == "" && cmd.relative == nil
+}
+
+// stateEffect sets one field of the playback state, addressed by its JSON
+// path (e.g. device.volume_percent).
+type stateEffect struct {
+	path  []string
+	value any
+	// advances marks a position that keeps moving while playing
+	// (progress_ms); snapshots within positionTolerance of the expected
+	// position confirm it.
+	advances bool
+}
+
+func setField(value any, path ...string) stateEffect {
+	return stateEffect{path: path, value: value}
+}
+
+func setProgress(positionMS int) stateEffect {
+	return stateEffect{path: []string{"progress_ms"}, value: positionMS, advances: true}
+}
+
+// commandResult is the outcome of the upstream call that carried a command.
+type commandResult struct {
+	// cmd is the command actually sent, which for a coalesced request may
+	// carry a later value.
+	cmd    playerCommand
+	sentAt time.Time
+	status int
+	body   []byte
+	err    error
+	queue  queueStats
+	// merged is how many requests the call served.
+	merged int
+}
+
+// sendCommand sends cmd to Spotify once the commands queued ahead of it are
+// done.
+func sendCommand(ctx context.Context, spotify *SpotifyClient, queue *commandQueue, cmd playerCommand) commandResult {
+	res := commandResult{cmd: cmd, merged: 1}
+	if cmd.noop() {
+		res.sentAt, res.status = time.Now(), http.StatusNoContent
+		return res
+	}
+	stats, err := queue.run(ctx, func(ctx context.Context) {
+		res.sentAt = time.Now()
+		res.status, res.body, res.err = spotify.Do(ctx, cmd.method, cmd.path, cmd.query, cmd.body)
+	})
+	res.queue = stats
+	if err != nil {
+		res.err = err
+	}
+	return res
+}
+
+// writeCommandHeaders reports how the command went through the queue and
+// whether one upstream call served several coalesced requests.
+func writeCommandHeaders(w http.ResponseWriter, res commandResult) {
+	h := w.Header()
+	h.Set("X-Queue-Position", intString(res.queue.position))
+	h.Set("X-Queue-Wait-Ms", strconv.FormatInt(res.queue.waited.Milliseconds(), 10))
+	h.Set("X-Command-Duration-Ms", strconv.FormatInt(res.queue.ran.Milliseconds(), 10))
+	if res.merged > 1 {
+		h.Set("X-Coalesced-Requests", intString(res.merged))
+	}
+}
+
+type playOffset struct {
+	Position *int   `json:"position,omitempty"`
+	URI      string `json:"uri,omitempty"`
+}
+
+type playRequest struct {
+	ContextURI string      `json:"context_uri,omitempty"`
+	URIs       []string    `json:"uris,omitempty"`
+	Offset     *playOffset `json:"offset,omitempty"`
+	PositionMS *int        `json:"position_ms,omitempty"`
+	DeviceID   string      `json:"device_id,omitempty"`
+}
+
+func (p playRequest) command() (playerCommand, *apiError) {
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	body := map[string]any{}
+	if p.ContextURI != "" && len(p.URIs) > 0 {
+		return playerCommand{}, invalidField("uris", "context_uri and uris are mutually exclusive")
+	}
+	if p.ContextURI != "" {
+		uri, apiErr := normalizeSpotifyURI("context_uri", p.ContextURI, contextTypes)
+		if apiErr != nil {
+			return playerCommand{}, apiErr
+		}
+		body["context_uri"] = uri
+	}
+	if len(p.URIs) > 100 {
+		return playerCommand{}, invalidField("uris", "uris accepts at most 100 entries")
+	}
+	if len(p.URIs) > 0 {
+		uris := make([]string, 0, len(p.URIs))
+		for _, raw := range p.URIs {
+			uri, apiErr := normalizeSpotifyURI("uris", raw, playableTypes)
+			if apiErr != nil {
+				return playerCommand{}, apiErr
+			}
+			uris = append(uris, uri)
+		}
+		body["uris"] = uris
+	}
+	if p.Offset != nil {
+		offset := map[string]any{}
+		switch {
+		case p.Offset.Position != nil && p.Offset.URI != "":
+			return playerCommand{}, invalidField("offset", "offset takes either position or uri")
+		case p.Offset.Position != nil:
+			if apiErr := validatePosition("offset.position", *p.Offset.Position); apiErr != nil {
+				return playerCommand{}, apiErr
+			}
+			offset["position"] = *p.Offset.Position
+		case p.Offset.URI != "":
+			uri, apiErr := normalizeSpotifyURI("offset.uri", p.Offset.URI, playableTypes)
+			if apiErr != nil {
+				return playerCommand{}, apiErr
+			}
+			offset["uri"] = uri
+		default:
+			return playerCommand{}, invalidField("offset", "offset requires position or uri")
+		}
+		body["offset"] = offset
+	}
+	if p.PositionMS != nil {
+		if apiErr := validatePosition("position_ms", *p.PositionMS); apiErr != nil {
+			return playerCommand{}, apiErr
+		}
+		body["position_ms"] = *p.PositionMS
+	}
+
+	effects := []stateEffect{setField(true, "is_playing")}
+	switch {
+	case p.PositionMS != nil:
+		effects = append(effects, setProgress(*p.PositionMS))
+	case len(body) > 0:
+		// A new context or track list starts from the beginning.
+		effects = append(effects, setProgress(0))
+	}
+	return playerCommand{
+		name:     "play",
+		method:   http.MethodPut,
+		path:     "/me/player/play",
+		query:    deviceQuery(p.DeviceID),
+		body:     body,
+		deviceID: p.DeviceID,
+		effects:  effects,
+	}, nil
+}
+
+func pauseCommand() playerCommand {
+	return playerCommand{
+		name:    "pause",
+		method:  http.MethodPut,
+		path:    "/me/player/pause",
+		effects: []stateEffect{setField(false, "is_playing")},
+	}
+}
+
+// nextCommand skips to the next item. Which item that is only shows in the
+// next snapshot, so nothing is projected; ?wait=confirm waits for it.
+func nextCommand() playerCommand {
+	return playerCommand{
+		name:    "next",
+		method:  http.MethodPost,
+		path:    "/me/player/next",
+		confirm: trackChanged,
+	}
+}
+
+func previousCommand() playerCommand {
+	return playerCommand{
+		name:    "previous",
+		method:  http.MethodPost,
+		path:    "/me/player/previous",
+		confirm: trackChangedOrRestarted,
+	}
+}
+
+type shuffleRequest struct {
+	State bool `json:"state"`
+}
+
+func (p shuffleRequest) command() (playerCommand, *apiError) {
+	query := url.Values{}
+	query.Set("state", boolString(p.State))
+	return playerCommand{
+		name:    "shuffle",
+		method:  http.MethodPut,
+		path:    "/me/player/shuffle",
+		query:   query,
+		effects: []stateEffect{setField(p.State, "shuffle_state")},
+	}, nil
+}
+
+type repeatRequest struct {
+	State string `json:"state"`
+}
+
+func (p repeatRequest) command() (playerCommand, *apiError) {
+	if p.State == "" {
+		p.State = "off"
+	}
+	if apiErr := validateRepeat(p.State); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	query := url.Values{}
+	query.Set("state", p.State)
+	return playerCommand{
+		name:    "repeat",
+		method:  http.MethodPut,
+		path:    "/me/player/repeat",
+		query:   query,
+		effects: []stateEffect{setField(p.State, "repeat_state")},
+	}, nil
+}
+
+type volumeRequest struct {
+	VolumePercent *int   `json:"volume_percent"`
+	Delta         *int   `json:"delta"`
+	DeviceID      string `json:"device_id"`
+}
+
+func (p volumeRequest) command() (playerCommand, *apiError) {
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	switch {
+	case p.VolumePercent != nil && p.Delta != nil:
+		return playerCommand{}, invalidField("delta", "volume_percent and delta are mutually exclusive")
+	case p.Delta != nil:
+		delta := *p.Delta
+		if delta < -100 || delta > 100 {
+			return playerCommand{}, invalidField("delta", "delta must be between -100 and 100")
+		}
+		return relativeCommand("volume", p.DeviceID, func(rc relativeContext) (playerCommand, *apiError) {
+			current, apiErr := rc.volume()
+			if apiErr != nil {
+				return playerCommand{}, apiErr
+			}
+			return volumeCommand(clamp(current+delta, 0, 100), p.DeviceID), nil
+		}), nil
+	case p.VolumePercent == nil:
+		return playerCommand{}, invalidField("volume_percent", "missing volume_percent")
+	}
+	if apiErr := validateVolume(*p.VolumePercent); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	return volumeCommand(*p.VolumePercent, p.DeviceID), nil
+}
+
+func volumeCommand(percent int, deviceID string) playerCommand {
+	query := deviceQuery(deviceID)
+	query.Set("volume_percent", intString(percent))
+	return playerCommand{
+		name:     "volume",
+		method:   http.MethodPut,
+		path:     "/me/player/volume",
+		query:    query,
+		deviceID: deviceID,
+		effects:  []stateEffect{setField(percent, "device", "volume_percent")},
+		coalesce: "volume",
+		applied:  map[string]any{"volume_percent": percent},
+	}
+}
+
+type seekRequest struct {
+	PositionMS *int   `json:"position_ms"`
+	OffsetMS   *int   `json:"offset_ms"`
+	DeviceID   string `json:"device_id"`
+}
+
+func (p seekRequest) command() (playerCommand, *apiError) {
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	switch {
+	case p.PositionMS != nil && p.OffsetMS != nil:
+		return playerCommand{}, invalidField("offset_ms", "position_ms and offset_ms are mutually exclusive")
+	case p.OffsetMS != nil:
+		offset := *p.OffsetMS
+		return relativeCommand("seek", p.DeviceID, func(rc relativeContext) (playerCommand, *apiError) {
+			position, duration, apiErr := rc.position()
+			if apiErr != nil {
+				return playerCommand{}, apiErr
+			}
+			return seekCommand(clamp(position+offset, 0, duration), p.DeviceID), nil
+		}), nil
+	case p.PositionMS == nil:
+		return playerCommand{}, invalidField("position_ms", "missing position_ms")
+	}
+	if apiErr := validatePosition("position_ms", *p.PositionMS); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	return seekCommand(*p.PositionMS, p.DeviceID), nil
+}
+
+func seekCommand(positionMS int, deviceID string) playerCommand {
+	query := deviceQuery(deviceID)
+	query.Set("position_ms", intString(positionMS))
+	return playerCommand{
+		name:     "seek",
+		method:   http.MethodPut,
+		path:     "/me/player/seek",
+		query:    query,
+		deviceID: deviceID,
+		effects:  []stateEffect{setProgress(positionMS)},
+		coalesce: "seek",
+		applied:  map[string]any{"position_ms": positionMS},
+	}
+}
+
+type queueAddRequest struct {
+	URI      string `json:"uri"`
+	DeviceID string `json:"device_id"`
+}
+
+func (p queueAddRequest) command() (playerCommand, *apiError) {
+	if p.URI == "" {
+		return playerCommand{}, invalidField("uri", "missing uri")
+	}
+	uri, apiErr := normalizeSpotifyURI("uri", p.URI, playableTypes)
+	if apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	query := deviceQuery(p.DeviceID)
+	query.Set("uri", uri)
+	return playerCommand{
+		name:     "queue.add",
+		method:   http.MethodPost,
+		path:     "/me/player/queue",
+		query:    query,
+		deviceID: p.DeviceID,
+	}, nil
+}
+
+type transferRequest struct {
+	DeviceID string `json:"device_id"`
+	Play     bool   `json:"play"`
+}
+
+// command moves playback to the device. It is sent as requested; the rest
+// of the device object is projected from what is already known about it
+// (see knownDevice), so a device missing from the list still transfers.
+func (p transferRequest) command() (playerCommand, *apiError) {
+	if p.DeviceID == "" {
+		return playerCommand{}, invalidField("device_id", "missing device_id")
+	}
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	return transferCommand(p.DeviceID, p.Play), nil
+}
+
+func transferCommand(deviceID string, play bool) playerCommand {
+	effects := []stateEffect{
+		setField(deviceID, "device", "id"),
+		setField(true, "device", "is_active"),
+	}
+	if play {
+		effects = append(effects, setField(true, "is_playing"))
+	}
+	return playerCommand{
+		name:   "transfer",
+		method: http.MethodPut,
+		path:   "/me/player",
+		body: map[string]any{
+			"device_ids": []string{deviceID},
+			"play":       play,
+		},
+		deviceID:  deviceID,
+		effects:   effects,
+		confirm:   deviceActive(deviceID, play),
+		activates: true,
+	}
+}
+
+// deviceEffects projects the fields of a known device object, apart from
+// the ones effects already sets.
+func deviceEffects(device map[string]any, effects []stateEffect) []stateEffect {
+	set := map[string]bool{}
+	for _, effect := range effects {
+		if len(effect.path) == 2 && effect.path[0] == "device" {
+			set[effect.path[1]] = true
+		}
+	}
+	keys := make([]string, 0, len(device))
+	for key := range device {
+		if !set[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		effects = append(effects, setField(device[key], "device", key))
+	}
+	return effects
+}
+
+func deviceQuery(deviceID string) url.Values {
+	query := url.Values{}
+	if deviceID != "" {
+		query.Set("device_id", deviceID)
+	}
+	return query
+}
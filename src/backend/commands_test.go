@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const phoneActiveState = `{"is_playing":false,"progress_ms":1000,` +
+	`"device":{"id":"phone","name":"Phone","type":"Smartphone","is_active":true,"volume_percent":80},` +
+	`"item":{"id":"t1","duration_ms":200000}}`
+
+func TestTransferProjectsWholeDevice(t *testing.T) {
+	cache := NewPlaybackCache()
+	cache.Set([]byte(phoneActiveState))
+	speaker := map[string]any{"id": "speaker", "name": "Kitchen", "type": "Speaker", "is_active": false, "volume_percent": 30.0}
+	cmd := transferCommand("speaker", true)
+	cmd.effects = deviceEffects(speaker, cmd.effects)
+
+	projected, ok := cache.Project(cmd.effects)
+	if !ok {
+		t.Fatal("nothing projected")
+	}
+	state, _ := decodeState(projected)
+	device, _ := state["device"].(map[string]any)
+	want := map[string]any{"id": "speaker", "name": "Kitchen", "type": "Speaker", "is_active": true, "volume_percent": 30}
+	for key, value := range want {
+		if !sameJSONValue(device[key], value) {
+			t.Errorf("device.%s = %v, want %v", key, device[key], value)
+		}
+	}
+	if playing, _ := state["is_playing"].(bool); !playing {
+		t.Errorf("is_playing = false, want true")
+	}
+
+	// A snapshot showing the new device confirms every projected field, so
+	// later changes to it are not masked.
+	confirmed := `{"is_playing":true,"progress_ms":1200,` +
+		`"device":{"id":"speaker","name":"Kitchen","type":"Speaker","is_active":true,"volume_percent":30},` +
+		`"item":{"id":"t1","duration_ms":200000}}`
+	cache.Set([]byte(confirmed))
+	if n := len(cache.overlays); n != 0 {
+		t.Errorf("%d overlays left after a confirming snapshot", n)
+	}
+}
+
+func TestTransferNeedsNoDeviceList(t *testing.T) {
+	var transfers, listReads atomic.Int32
+	stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player/devices":
+			listReads.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"devices":[{"id":"speaker","name":"Kitchen","type":"Speaker","is_active":false,"volume_percent":30}]}`))
+		case "/v1/me/player":
+			transfers.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	a := NewAPI(spotify, NewPlaybackCache())
+	a.Playback.Set([]byte(phoneActiveState))
+
+	transfer := func(id string) map[string]any {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.handleTransfer(w, httptest.NewRequest(http.MethodPost, "/api/transfer", strings.NewReader(`{"device_id":"`+id+`"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("transfer to %s: status = %d %s", id, w.Code, w.Body)
+		}
+		var state map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+		device, _ := state["device"].(map[string]any)
+		return device
+	}
+
+	// A device missing from every list still transfers, with only what the
+	// request says about it projected.
+	device := transfer("unlisted")
+	if device["id"] != "unlisted" || device["is_active"] != true {
+		t.Errorf("device = %v, want unlisted and active", device)
+	}
+	if n := listReads.Load(); n != 0 {
+		t.Errorf("device list read %d times, want 0", n)
+	}
+
+	// Once /api/devices has listed it, the device is described in full.
+	w := httptest.NewRecorder()
+	a.handleDevices(w, httptest.NewRequest(http.MethodGet, "/api/devices", nil))
+	if device := transfer("speaker"); device["name"] != "Kitchen" || device["is_active"] != true {
+		t.Errorf("device = %v, want the listed Kitchen speaker, active", device)
+	}
+	if n := transfers.Load(); n != 2 {
+		t.Errorf("transfers sent = %d, want 2", n)
+	}
+}
+
+func TestDeviceActiveConfirm(t *testing.T) {
+	phone, _ := decodeState([]byte(phoneActiveState))
+	paused, _ := decodeState([]byte(`{"is_playing":false,"device":{"id":"speaker"}}`))
+	playing, _ := decodeState([]byte(`{"is_playing":true,"device":{"id":"speaker"}}`))
+	tests := []struct {
+		name  string
+		play  bool
+		after map[string]any
+		want  bool
+	}{
+		{"old device still active", false, phone, false},
+		{"new device active", false, paused, true},
+		{"new device active but paused", true, paused, false},
+		{"new device playing", true, playing, true},
+	}
+	for _, tt := range tests {
+		if got := deviceActive("speaker", tt.play)(nil, tt.after); got != tt.want {
+			t.Errorf("%s: confirmed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextProjectsNothing(t *testing.T) {
+	for _, cmd := range []playerCommand{nextCommand(), previousCommand()} {
+		if len(cmd.effects) != 0 {
+			t.Errorf("%s projects %v; the next item is not known yet", cmd.name, cmd.effects)
+		}
+		if cmd.confirm == nil {
+			t.Errorf("%s has no confirmation check", cmd.name)
+		}
+	}
+}
+
+func TestResolveReadsSpotifyOutsideTheLock(t *testing.T) {
+	gate, listing := make(chan struct{}), make(chan struct{}, 1)
+	stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/me/player/devices" {
+			listing <- struct{}{}
+			<-gate
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"devices":[{"id":"speaker","volume_percent":30}]}`))
+	}))
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "access")
+	a := NewAPI(spotify, NewPlaybackCache())
+	a.Playback.Set([]byte(phoneActiveState))
+
+	// Muting a device that is not active reads the device list...
+	muted := make(chan *apiError, 1)
+	go func() {
+		cmd, _ := muteRequest{DeviceID: "speaker"}.command()
+		_, apiErr := a.resolve(context.Background(), cmd)
+		muted <- apiErr
+	}()
+	<-listing
+
+	// ...while a volume step on the active device resolves meanwhile.
+	delta := -10
+	step, _ := volumeRequest{Delta: &delta}.command()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, apiErr := a.resolve(context.Background(), step); apiErr != nil {
+			t.Errorf("volume step: %v", apiErr)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("volume step waited for another command's device list read")
+	}
+	close(gate)
+	if apiErr := <-muted; apiErr != nil {
+		t.Fatalf("mute: %v", apiErr)
+	}
+}
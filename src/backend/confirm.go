@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Read-after-write confirmation (?wait=confirm) polls /me/player after a
+// command until the change is visible, so automations can rely on it before
+// their next step.
+const (
+	defaultConfirmTimeout = 5 * time.Second
+	// maxConfirmTimeout leaves room within commandTimeout for the command
+	// itself and the response.
+	maxConfirmTimeout = 8 * time.Second
+	confirmPollMin    = 150 * time.Millisecond
+	confirmPollMax    = time.Second
+)
+
+const (
+	confirmStatusConfirmed    = "confirmed"
+	confirmStatusNotConfirmed = "not_confirmed"
+)
+
+// confirmCheck reports whether after shows the command took effect. before
+// is the state read just before the command was sent, or nil if none.
+type confirmCheck func(before, after map[string]any) bool
+
+type confirmResult struct {
+	Status    string          `json:"status"`
+	State     json.RawMessage `json:"state"`
+	ElapsedMS int64           `json:"elapsed_ms"`
+}
+
+// parseConfirm reads ?wait=confirm and the optional ?timeout_ms. It returns
+// 0 when the caller did not ask to wait.
+func parseConfirm(r *http.Request, cmd playerCommand) (time.Duration, *apiError) {
+	q := r.URL.Query()
+	switch q.Get("wait") {
+	case "":
+		return 0, nil
+	case "confirm":
+	default:
+		return 0, invalidField("wait", "wait must be confirm")
+	}
+	if cmd.confirm == nil && len(cmd.effects) == 0 && cmd.relative == nil {
+		return 0, invalidField("wait", "%s has no visible effect to confirm", cmd.name)
+	}
+	timeout := defaultConfirmTimeout
+	if raw := q.Get("timeout_ms"); raw != "" {
+		ms, err := strconv.Atoi(raw)
+		if err != nil || ms < 100 || time.Duration(ms)*time.Millisecond > maxConfirmTimeout {
+			return 0, invalidField("timeout_ms", "timeout_ms must be between 100 and %d", maxConfirmTimeout.Milliseconds())
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	return timeout, nil
+}
+
+// confirmedBy reports whether after shows cmd, sent at sentAt, took effect.
+func (cmd playerCommand) confirmedBy(before, after map[string]any, sentAt, now time.Time) bool {
+	if cmd.confirm != nil {
+		return cmd.confirm(before, after)
+	}
+	for _, effect := range cmd.effects {
+		if !confirms(after, effect, sentAt, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// currentState reads /me/player for commands whose confirmation compares
+// against the state before them. It returns nil when there is none.
+func (a *API) currentState(r *http.Request) map[string]any {
+	status, body, err := a.Spotify.Do(r.Context(), http.MethodGet, "/me/player", nil, nil)
+	if err != nil || status == http.StatusNoContent || len(body) == 0 {
+		return nil
+	}
+	a.Playback.Set(body)
+	state, _ := decodeState(body)
+	return state
+}
+
+// awaitConfirmation polls /me/player with backoff until cmd is visible or
+// timeout passes. Polls run on the request context rather than one bounded
+// by timeout, so giving up never cuts a Spotify call short.
+func (a *API) awaitConfirmation(r *http.Request, cmd playerCommand, before map[string]any, sentAt time.Time, timeout time.Duration) confirmResult {
+	deadline := sentAt.Add(timeout)
+	delay := confirmPollMin
+	var last []byte
+	result := func(status string) confirmResult {
+		annotateSpan(r.Context(), confirmStatusAttr(status))
+		return confirmResult{Status: status, State: last, ElapsedMS: time.Since(sentAt).Milliseconds()}
+	}
+	for {
+		wait := min(delay, time.Until(deadline))
+		if wait <= 0 {
+			return result(confirmStatusNotConfirmed)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return result(confirmStatusNotConfirmed)
+		case <-timer.C:
+		}
+		delay = min(delay*2, confirmPollMax)
+
+		status, body, err := a.Spotify.Do(r.Context(), http.MethodGet, "/me/player", nil, nil)
+		if err != nil || status == http.StatusNoContent || len(body) == 0 {
+			continue
+		}
+		a.Playback.Set(body)
+		last = body
+		if state, ok := decodeState(body); ok && cmd.confirmedBy(before, state, sentAt, time.Now()) {
+			return result(confirmStatusConfirmed)
+		}
+	}
+}
+
+func trackID(state map[string]any) string {
+	id, _ := getStatePath(state, []string{"item", "id"})
+	s, _ := id.(string)
+	return s
+}
+
+// trackChanged confirms /api/next: a different item is playing.
+func trackChanged(before, after map[string]any) bool {
+	id := trackID(after)
+	return id != "" && id != trackID(before)
+}
+
+// deviceActive confirms /api/transfer: the device is the active one, and
+// playing when play was asked for.
+func deviceActive(id string, play bool) confirmCheck {
+	return func(_, after map[string]any) bool {
+		active, _ := getStatePath(after, []string{"device", "id"})
+		if active != id {
+			return false
+		}
+		playing, _ := after["is_playing"].(bool)
+		return playing || !play
+	}
+}
+
+// trackChangedOrRestarted confirms /api/previous, which restarts the
+// current track instead when it has played for a few seconds.
+func trackChangedOrRestarted(before, after map[string]any) bool {
+	if trackChanged(before, after) {
+		return true
+	}
+	if before == nil || trackID(after) == "" {
+		return false
+	}
+	prev, ok := getStatePath(before, []string{"progress_ms"})
+	if !ok {
+		return false
+	}
+	cur, ok := getStatePath(after, []string{"progress_ms"})
+	return ok && toFloat(cur) < toFloat(prev)
+}
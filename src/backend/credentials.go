@@ -0,0 +1,144 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requiredScopes are the OAuth scopes the player needs to work.
+var requiredScopes = []string{
+	"user-read-playback-state",
+	"user-modify-playback-state",
+	"user-read-currently-playing",
+}
+
+// optionalScopes improve some features but are not needed for playback,
+// each with what is lost without it. user-read-private exposes the
+// account's country, the default market for search and catalog reads.
+var optionalScopes = map[string]string{
+	"user-read-private": "search and catalog reads run without a market",
+}
+
+type CredentialCheck struct {
+	OK            bool     `json:"ok"`
+	Stage         string   `json:"stage,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+	MissingScopes []string `json:"missing_scopes,omitempty"`
+	Product       string   `json:"product,omitempty"`
+	DisplayName   string   `json:"display_name,omitempty"`
+	UserID        string   `json:"user_id,omitempty"`
+	// RefreshTokenRotated reports that Spotify returned a new refresh token
+	// in the exchange; the tested one may no longer be valid.
+	RefreshTokenRotated bool `json:"refresh_token_rotated,omitempty"`
+	// Warnings describe missing optional scopes; they do not fail the check.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// rotatedRefresh is the new refresh token, for the caller to persist.
+	rotatedRefresh string
+}
+
+// CheckSpotifyCredentials exchanges the refresh token for an access token and
+// reads the account profile, without touching any stored state. When Spotify
+// rotates the refresh token, the new one is kept in the result so the caller
+// can write it back.
+func CheckSpotifyCredentials(ctx context.Context, clientID, clientSecret, refreshToken string) CredentialCheck {
+	var missing []string
+	if strings.TrimSpace(clientID) == "" {
+		missing = append(missing, "SPOTIFY_CLIENT_ID")
+	}
+	if strings.TrimSpace(clientSecret) == "" {
+		missing = append(missing, "SPOTIFY_CLIENT_SECRET")
+	}
+	if strings.TrimSpace(refreshToken) == "" {
+		missing = append(missing, "SPOTIFY_REFRESH_TOKEN")
+	}
+	if len(missing) > 0 {
+		return CredentialCheck{Stage: "config", Error: "missing " + strings.Join(missing, ", ")}
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	tok, err := requestToken(ctx, httpClient, clientID, clientSecret, refreshToken)
+	if err != nil {
+		return CredentialCheck{Stage: "token", Error: err.Error()}
+	}
+
+	out := CredentialCheck{Stage: "profile", Scopes: strings.Fields(tok.Scope)}
+	if rotated := strings.TrimSpace(tok.RefreshToken); rotated != "" && rotated != strings.TrimSpace(refreshToken) {
+		out.RefreshTokenRotated = true
+		out.rotatedRefresh = rotated
+	}
+	sort.Strings(out.Scopes)
+	granted := map[string]struct{}{}
+	for _, scope := range out.Scopes {
+		granted[scope] = struct{}{}
+	}
+	for _, scope := range requiredScopes {
+		if _, ok := granted[scope]; !ok {
+			out.MissingScopes = append(out.MissingScopes, scope)
+		}
+	}
+	for scope, without := range optionalScopes {
+		if _, ok := granted[scope]; !ok {
+			out.Warnings = append(out.Warnings, "missing optional scope "+scope+": "+without)
+		}
+	}
+	sort.Strings(out.Warnings)
+
+	profile, err := fetchProfile(ctx, httpClient, tok.AccessToken)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	out.Product = profile.Product
+	out.DisplayName = profile.DisplayName
+	out.UserID = profile.ID
+	out.Stage = ""
+	out.OK = len(out.MissingScopes) == 0
+	if !out.OK {
+		out.Error = "missing required scopes"
+	}
+	return out
+}
+
+type spotifyProfile struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Product     string `json:"product"`
+	Country     string `json:"country"`
+}
+
+func fetchProfile(ctx context.Context, httpClient *http.Client, accessToken string) (spotifyProfile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, spotifyAPIBase+"/me", nil)
+	if err != nil {
+		return spotifyProfile{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return spotifyProfile{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return spotifyProfile{}, err
+	}
+	if resp.StatusCode >= 400 {
+		return spotifyProfile{}, fmt.Errorf("profile error: %s", strings.TrimSpace(string(data)))
+	}
+	var profile spotifyProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return spotifyProfile{}, err
+	}
+	if profile.ID == "" {
+		return spotifyProfile{}, errors.New("missing id in profile response")
+	}
+	return profile, nil
+}
@@ -0,0 +1,40 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCheckCredentialsScopes(t *testing.T) {
+	const playback = "user-read-playback-state user-modify-playback-state user-read-currently-playing"
+	tests := []struct {
+		name     string
+		scopes   string
+		ok       bool
+		missing  int
+		warnings int
+	}{
+		{name: "all scopes", scopes: playback + " user-read-private", ok: true},
+		{name: "no user-read-private", scopes: playback, ok: true, warnings: 1},
+		{name: "no playback control", scopes: "user-read-playback-state user-read-currently-playing user-read-private", missing: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == "/api/token" {
+					fmt.Fprintf(w, `{"access_token":"access","token_type":"Bearer","expires_in":3600,"scope":%q}`, tt.scopes)
+					return
+				}
+				fmt.Fprint(w, `{"id":"alice","display_name":"Alice","product":"premium"}`)
+			}))
+			got := CheckSpotifyCredentials(context.Background(), "client", "secret", "refresh")
+			if got.OK != tt.ok || len(got.MissingScopes) != tt.missing || len(got.Warnings) != tt.warnings {
+				t.Fatalf("check = ok %v, missing %v, warnings %v; want ok %v, %d missing, %d warnings",
+					got.OK, got.MissingScopes, got.Warnings, tt.ok, tt.missing, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Getenv returns the trimmed value of key, or fallback when it is unset or
+// blank.
+func Getenv(key, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// GetenvInt returns key as an int, or fallback when it is unset or not a
+// number.
+func GetenvInt(key string, fallback int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// GetenvDuration returns key as a positive duration, or fallback.
+func GetenvDuration(key string, fallback time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// GetenvFloat returns key as a positive number, or fallback.
+func GetenvFloat(key string, fallback float64) float64 {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return fallback
+	}
+	return f
+}
@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const maxImageBytes = 5 << 20
+
+// imageHostSuffixes is the Spotify CDN allowlist for the album-art proxy.
+var imageHostSuffixes = []string{".scdn.co", ".spotifycdn.com"}
+
+var allowedImageTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/webp": {},
+	"image/gif":  {},
+}
+
+// ImageProxy serves Spotify CDN images from the integration's own origin so
+// the Content-Security-Policy does not need to allow remote image hosts.
+// Fetched images are cached on disk; the least recently used files are
+// evicted once the cache exceeds maxBytes.
+type ImageProxy struct {
+	dir        string
+	maxBytes   int64
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	size      int64
+	sizeKnown bool
+}
+
+func NewImageProxy(dir string, maxBytes int64) *ImageProxy {
+	if maxBytes <= 0 {
+		maxBytes = 64 << 20
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return validateImageURL(req.URL)
+		},
+	}
+	return &ImageProxy{dir: dir, maxBytes: maxBytes, httpClient: client}
+}
+
+func NewImageProxyFromEnv() *ImageProxy {
+	dir := Getenv("IMAGE_CACHE_DIR", filepath.Join("config", "image-cache"))
+	maxBytes := int64(GetenvInt("IMAGE_CACHE_MAX_BYTES", 64<<20))
+	return NewImageProxy(filepath.Clean(dir), maxBytes)
+}
+
+func (p *ImageProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("url"))
+	target, err := url.Parse(raw)
+	if raw == "" || err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid url")
+		return
+	}
+	if err := validateImageURL(target); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key := imageCacheKey(target.String())
+	etag := `"` + key[:32] + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := p.load(key)
+	annotateSpan(r.Context(), attribute.Bool("image.cache_hit", err == nil))
+	if err != nil {
+		data, err = p.fetch(r, target)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		p.store(key, data)
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func validateImageURL(u *url.URL) error {
+	if u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return errors.New("image url must be a plain https url")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, suffix := range imageHostSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image host %q is not allowed", host)
+}
+
+func (p *ImageProxy) fetch(r *http.Request, target *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image upstream status %d", resp.StatusCode)
+	}
+	declared := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	if _, ok := allowedImageTypes[declared]; !ok {
+		return nil, fmt.Errorf("unsupported image content type %q", declared)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageBytes {
+		return nil, errors.New("image too large")
+	}
+	// The declared type must agree with the bytes actually returned.
+	if _, ok := allowedImageTypes[http.DetectContentType(data)]; !ok {
+		return nil, errors.New("image content does not match an allowed type")
+	}
+	return data, nil
+}
+
+func imageCacheKey(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *ImageProxy) path(key string) string {
+	return filepath.Join(p.dir, key)
+}
+
+func (p *ImageProxy) load(key string) ([]byte, error) {
+	if p.dir == "" {
+		return nil, os.ErrNotExist
+	}
+	path := p.path(key)
+	data, err := os.ReadFile(path) // #nosec G304 -- file name is a sha256 hex digest
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := allowedImageTypes[http.DetectContentType(data)]; !ok {
+		_ = os.Remove(path)
+		return nil, os.ErrNotExist
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return data, nil
+}
+
+func (p *ImageProxy) store(key string, data []byte) {
+	if p.dir == "" || int64(len(data)) > p.maxBytes {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		slog.Warn("image cache", "err", err)
+		return
+	}
+	if !p.sizeKnown {
+		p.size = p.scanSizeUnlocked()
+		p.sizeKnown = true
+	}
+	tmp := p.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		slog.Warn("image cache", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, p.path(key)); err != nil {
+		_ = os.Remove(tmp)
+		slog.Warn("image cache", "err", err)
+		return
+	}
+	p.size += int64(len(data))
+	if p.size > p.maxBytes {
+		p.evictUnlocked()
+	}
+}
+
+func (p *ImageProxy) scanSizeUnlocked() int64 {
+	var total int64
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return 0
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// evictUnlocked removes the least recently used files until the cache is
+// back under 90% of its cap.
+func (p *ImageProxy) evictUnlocked() {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return
+	}
+	type cached struct {
+		name string
+		size int64
+		used time.Time
+	}
+	files := make([]cached, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cached{name: entry.Name(), size: info.Size(), used: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].used.Before(files[b].used) })
+	target := p.maxBytes * 9 / 10
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(filepath.Join(p.dir, f.name)); err == nil {
+			total -= f.size
+		}
+	}
+	p.size = total
+}
@@ -0,0 +1,173 @@
+package backend
+
+import "sync"
+
+// defaultUnmuteVolume is restored when a muted device has no remembered
+// volume, e.g. it was muted from the Spotify app.
+const defaultUnmuteVolume = 50
+
+// MuteMemory remembers each device's volume from before it was muted, so
+// unmute can restore it. It is persisted with the rest of the state.
+type MuteMemory struct {
+	mu      sync.Mutex
+	volumes map[string]int
+	// OnChange, when set, is called after the remembered volumes change.
+	OnChange func()
+}
+
+func NewMuteMemory() *MuteMemory {
+	return &MuteMemory{volumes: map[string]int{}}
+}
+
+func (m *MuteMemory) remember(deviceID string, volume int) {
+	m.update(func() bool {
+		if m.volumes[deviceID] == volume {
+			return false
+		}
+		m.volumes[deviceID] = volume
+		return true
+	})
+}
+
+func (m *MuteMemory) forget(deviceID string) {
+	m.update(func() bool {
+		if _, ok := m.volumes[deviceID]; !ok {
+			return false
+		}
+		delete(m.volumes, deviceID)
+		return true
+	})
+}
+
+func (m *MuteMemory) recall(deviceID string) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.volumes[deviceID]
+	return v, ok
+}
+
+func (m *MuteMemory) update(fn func() bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	changed := fn()
+	onChange := m.OnChange
+	m.mu.Unlock()
+	if changed && onChange != nil {
+		onChange()
+	}
+}
+
+func (m *MuteMemory) snapshot() map[string]int {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.volumes) == 0 {
+		return nil
+	}
+	out := make(map[string]int, len(m.volumes))
+	for id, v := range m.volumes {
+		out[id] = v
+	}
+	return out
+}
+
+func (m *MuteMemory) restore(volumes map[string]int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, v := range volumes {
+		if v > 0 && v <= 100 {
+			m.volumes[id] = v
+		}
+	}
+}
+
+type muteRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// command mutes by setting the volume to 0. The volume it had is remembered
+// once Spotify accepts the change. Muting a device already at 0 changes
+// nothing.
+func (p muteRequest) command() (playerCommand, *apiError) {
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	return targetCommand("mute", p.DeviceID, func(rc relativeContext) (playerCommand, *apiError) {
+		device, active, apiErr := rc.target()
+		if apiErr != nil {
+			return playerCommand{}, apiErr
+		}
+		current, apiErr := deviceVolume(device)
+		if apiErr != nil {
+			return playerCommand{}, apiErr
+		}
+		if current == 0 {
+			return playerCommand{name: "mute", deviceID: p.DeviceID}, nil
+		}
+		id, _ := device["id"].(string)
+		cmd := muteVolumeCommand("mute", 0, p.DeviceID, active)
+		cmd.onSuccess = func() { rc.mutes.remember(id, current) }
+		return cmd, nil
+	}), nil
+}
+
+type unmuteRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// command restores the volume remembered by mute. A device that is not at
+// volume 0 is left alone, and its remembered volume dropped. The memory only
+// changes once Spotify accepts the command, so a failed unmute can be
+// retried.
+func (p unmuteRequest) command() (playerCommand, *apiError) {
+	if apiErr := validateDeviceID("device_id", p.DeviceID); apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	return targetCommand("unmute", p.DeviceID, func(rc relativeContext) (playerCommand, *apiError) {
+		device, active, apiErr := rc.target()
+		if apiErr != nil {
+			return playerCommand{}, apiErr
+		}
+		current, apiErr := deviceVolume(device)
+		if apiErr != nil {
+			return playerCommand{}, apiErr
+		}
+		id, _ := device["id"].(string)
+		forget := func() { rc.mutes.forget(id) }
+		if current > 0 {
+			return playerCommand{name: "unmute", deviceID: p.DeviceID, onSuccess: forget}, nil
+		}
+		volume, ok := rc.mutes.recall(id)
+		if !ok {
+			volume = defaultUnmuteVolume
+		}
+		cmd := muteVolumeCommand("unmute", volume, p.DeviceID, active)
+		cmd.onSuccess = forget
+		return cmd, nil
+	}), nil
+}
+
+// muteVolumeCommand sets the volume for mute or unmute. Only the active
+// device's volume is part of the playback state, so for any other device
+// nothing is projected. It is not coalesced: a later volume request must not
+// stand in for it, or the remembered volume would be updated for a mute
+// that was never sent.
+func muteVolumeCommand(name string, percent int, deviceID string, active bool) playerCommand {
+	cmd := volumeCommand(percent, deviceID)
+	cmd.name = name
+	cmd.coalesce = ""
+	if !active {
+		cmd.effects = nil
+	}
+	return cmd
+}
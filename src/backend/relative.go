@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// relativeStateMaxAge is how old a cached snapshot may be to resolve a
+// relative command against; older ones are refreshed from Spotify first.
+const relativeStateMaxAge = 5 * time.Second
+
+// deviceListMaxAge is how long a device list read from Spotify is used to
+// describe the target of a transfer.
+const deviceListMaxAge = time.Minute
+
+// relativeContext is what a relative command is resolved against.
+type relativeContext struct {
+	// state is the current playback state, or nil when nothing is active.
+	state    map[string]any
+	deviceID string
+	mutes    *MuteMemory
+	// listed is the target device as read from the device list, for a
+	// command that may target a device that is not active; listErr is why it
+	// could not be read.
+	listed  map[string]any
+	listErr *apiError
+}
+
+func relativeCommand(name, deviceID string, build func(relativeContext) (playerCommand, *apiError)) playerCommand {
+	return playerCommand{name: name, deviceID: deviceID, relative: build}
+}
+
+// targetCommand is a relative command that may also target a device that is
+// not active, e.g. mute.
+func targetCommand(name, deviceID string, build func(relativeContext) (playerCommand, *apiError)) playerCommand {
+	cmd := relativeCommand(name, deviceID, build)
+	cmd.anyDevice = true
+	return cmd
+}
+
+func toggleCommand() playerCommand {
+	return relativeCommand("toggle", "", func(rc relativeContext) (playerCommand, *apiError) {
+		if playing, _ := rc.state["is_playing"].(bool); playing {
+			return pauseCommand(), nil
+		}
+		return playRequest{}.command()
+	})
+}
+
+// device returns the id of the device the command applies to. Relative
+// values are only known for the active device.
+func (rc relativeContext) device() (string, *apiError) {
+	if rc.state == nil {
+		return "", errNoActiveDevice()
+	}
+	active, _ := getStatePath(rc.state, []string{"device", "id"})
+	id, _ := active.(string)
+	if rc.deviceID != "" && rc.deviceID != id {
+		return "", invalidField("device_id", "relative changes need the active device")
+	}
+	return id, nil
+}
+
+func (rc relativeContext) volume() (int, *apiError) {
+	if _, apiErr := rc.device(); apiErr != nil {
+		return 0, apiErr
+	}
+	device, _ := getStatePath(rc.state, []string{"device"})
+	dev, _ := device.(map[string]any)
+	return deviceVolume(dev)
+}
+
+// target returns the device object a command applies to and whether it is
+// the active one. Unlike device, it accepts any available device; one that
+// is not active is read from the device list.
+func (rc relativeContext) target() (map[string]any, bool, *apiError) {
+	if device, ok := getStatePath(rc.state, []string{"device"}); ok {
+		dev, _ := device.(map[string]any)
+		if id, _ := dev["id"].(string); dev != nil && (rc.deviceID == "" || rc.deviceID == id) {
+			return dev, true, nil
+		}
+	}
+	if rc.listed == nil && rc.listErr == nil {
+		return nil, false, errNoActiveDevice()
+	}
+	return rc.listed, false, rc.listErr
+}
+
+func deviceVolume(dev map[string]any) (int, *apiError) {
+	if n, ok := numeric(dev["volume_percent"]); ok {
+		return int(n), nil
+	}
+	return 0, &apiError{Status: http.StatusConflict, Code: "volume_unavailable", Message: "the device does not report its volume"}
+}
+
+// position returns the current position and the item's duration.
+func (rc relativeContext) position() (int, int, *apiError) {
+	if _, apiErr := rc.device(); apiErr != nil {
+		return 0, 0, apiErr
+	}
+	durationMS, _ := getStatePath(rc.state, []string{"item", "duration_ms"})
+	duration := toFloat(durationMS)
+	if duration <= 0 {
+		return 0, 0, &apiError{Status: http.StatusConflict, Code: "nothing_playing", Message: "nothing is playing to seek in"}
+	}
+	progress, _ := getStatePath(rc.state, []string{"progress_ms"})
+	return int(toFloat(progress)), int(duration), nil
+}
+
+// resolve builds the absolute command for a relative one. Relative commands
+// are resolved one at a time and their effects projected right away, so a
+// quick series of volume steps each builds on the previous one even before
+// Spotify has answered. The caller retracts the projection if the command
+// then fails. Spotify is read before taking the lock, which only covers
+// building from the cached state and projecting. A command that activates a device also gets the fields of
+// that device projected, when they are already known.
+func (a *API) resolve(ctx context.Context, cmd playerCommand) (playerCommand, *apiError) {
+	if cmd.activates {
+		if device, ok := a.knownDevice(cmd.deviceID); ok {
+			cmd.effects = deviceEffects(device, cmd.effects)
+		}
+	}
+	if cmd.relative == nil {
+		return cmd, nil
+	}
+	state, apiErr := a.currentPlayback(ctx)
+	if apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	rc := relativeContext{deviceID: cmd.deviceID, mutes: a.Mutes}
+	if cmd.anyDevice && cmd.deviceID != "" && activeDeviceID(state) != cmd.deviceID {
+		rc.listed, rc.listErr = a.lookupDevice(ctx, cmd.deviceID)
+	}
+
+	a.relativeMu.Lock()
+	defer a.relativeMu.Unlock()
+	// Commands resolved while this one read Spotify are projected by now.
+	rc.state = state
+	if latest, ok := a.Playback.current(relativeStateMaxAge); ok {
+		rc.state = latest
+	}
+	resolved, apiErr := cmd.relative(rc)
+	if apiErr != nil {
+		return playerCommand{}, apiErr
+	}
+	if len(resolved.effects) > 0 {
+		a.Playback.Project(resolved.effects)
+	}
+	return resolved, nil
+}
+
+// currentPlayback returns the cached playback state if it is recent enough,
+// otherwise it reads it from Spotify. It returns nil when nothing is active.
+func (a *API) currentPlayback(ctx context.Context) (map[string]any, *apiError) {
+	if state, ok := a.Playback.current(relativeStateMaxAge); ok {
+		return state, nil
+	}
+	status, body, err := a.Spotify.Do(ctx, http.MethodGet, "/me/player", nil, nil)
+	if isNoActiveDevice(err) || (err == nil && (status == http.StatusNoContent || len(body) == 0)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, spotifyAPIError(err)
+	}
+	a.Playback.Set(body)
+	state, _ := a.Playback.current(relativeStateMaxAge)
+	return state, nil
+}
+
+func activeDeviceID(state map[string]any) string {
+	id, _ := getStatePath(state, []string{"device", "id"})
+	s, _ := id.(string)
+	return s
+}
+
+// lookupDevice returns the device with id from Spotify's device list.
+func (a *API) lookupDevice(ctx context.Context, id string) (map[string]any, *apiError) {
+	_, body, err := a.Spotify.Do(ctx, http.MethodGet, "/me/player/devices", nil, nil)
+	if err != nil {
+		return nil, spotifyAPIError(err)
+	}
+	devices, ok := parseDeviceList(body)
+	if !ok {
+		return nil, &apiError{Status: http.StatusBadGateway, Code: codeForStatus(http.StatusBadGateway), Message: "invalid device list from Spotify"}
+	}
+	a.devices.store(devices)
+	if dev := findDevice(devices, id); dev != nil {
+		return dev, nil
+	}
+	return nil, &apiError{Status: http.StatusNotFound, Code: codeDeviceNotFound, Message: "Spotify device not found", Field: "device_id"}
+}
+
+// knownDevice returns the device with id from the cached playback state or
+// the last device list read, without calling Spotify.
+func (a *API) knownDevice(id string) (map[string]any, bool) {
+	if payload, ok := a.Playback.Get(); ok {
+		if state, ok := decodeState(payload); ok {
+			dev, _ := state["device"].(map[string]any)
+			if devID, _ := dev["id"].(string); dev != nil && devID == id {
+				return dev, true
+			}
+		}
+	}
+	dev := findDevice(a.devices.recent(deviceListMaxAge), id)
+	return dev, dev != nil
+}
+
+// deviceListCache keeps the last device list read from Spotify.
+type deviceListCache struct {
+	mu        sync.Mutex
+	devices   []map[string]any
+	updatedAt time.Time
+}
+
+func (c *deviceListCache) store(devices []map[string]any) {
+	c.mu.Lock()
+	c.devices, c.updatedAt = devices, time.Now()
+	c.mu.Unlock()
+}
+
+// recent returns the cached list if it is at most maxAge old.
+func (c *deviceListCache) recent(maxAge time.Duration) []map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updatedAt) > maxAge {
+		return nil
+	}
+	return c.devices
+}
+
+func parseDeviceList(body []byte) ([]map[string]any, bool) {
+	var list struct {
+		Devices []map[string]any `json:"devices"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, false
+	}
+	return list.Devices, true
+}
+
+func findDevice(devices []map[string]any, id string) map[string]any {
+	for _, dev := range devices {
+		if devID, _ := dev["id"].(string); devID == id {
+			return dev
+		}
+	}
+	return nil
+}
+
+func errNoActiveDevice() *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: codeNoActiveDevice, Message: "No active Spotify device"}
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route timeouts bound the whole handler, including waiting for a token
+// refresh. They stay below the server's WriteTimeout so the error envelope
+// can still be written.
+const (
+	readTimeout    = 8 * time.Second
+	commandTimeout = 10 * time.Second
+	batchTimeout   = 14 * time.Second
+)
+
+// route is one entry of a declarative route table.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+	// timeout, when set, is applied to the request context.
+	timeout time.Duration
+	// needsSpotify answers not_configured while no Spotify client exists.
+	needsSpotify bool
+}
+
+// registerRoutes mounts routes using method patterns. Every path also gets a
+// catch-all that answers other methods with a 405 envelope and an Allow
+// header.
+func registerRoutes(mux *http.ServeMux, spotify *SpotifyClient, routes []route) {
+	allowed := map[string][]string{}
+	var paths []string
+	for _, rt := range routes {
+		h := http.Handler(rt.handler)
+		if rt.needsSpotify {
+			h = requireSpotify(spotify, h)
+		}
+		if rt.timeout > 0 {
+			h = withTimeout(rt.timeout, h)
+		}
+		mux.Handle(rt.method+" "+rt.path, h)
+		if _, ok := allowed[rt.path]; !ok {
+			paths = append(paths, rt.path)
+		}
+		allowed[rt.path] = append(allowed[rt.path], rt.method)
+		if rt.method == http.MethodGet {
+			// GET patterns also match HEAD.
+			allowed[rt.path] = append(allowed[rt.path], http.MethodHead)
+		}
+	}
+	for _, path := range paths {
+		mux.Handle(path, methodNotAllowed(allowed[path]))
+	}
+}
+
+func methodNotAllowed(methods []string) http.Handler {
+	sorted := append([]string(nil), methods...)
+	sort.Strings(sorted)
+	allow := strings.Join(sorted, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeAPIError(w, &apiError{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    "method_not_allowed",
+			Message: fmt.Sprintf("method %s is not allowed; use %s", r.Method, allow),
+		})
+	})
+}
+
+func requireSpotify(spotify *SpotifyClient, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spotify == nil {
+			writeAPIError(w, errNotConfigured())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func withTimeout(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// recoverPanics turns a handler panic into a logged 500 envelope instead of
+// a dropped connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &headerRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "handler panic",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(v),
+				"stack", string(debug.Stack()),
+			)
+			if !rec.wroteHeader {
+				writeJSONError(w, http.StatusInternalServerError, "internal error")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+type headerRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (r *headerRecorder) WriteHeader(status int) {
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *headerRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *headerRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
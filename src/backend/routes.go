@@ -1,335 +1,290 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 )
 
+// API serves the player routes under /api/.
+type API struct {
+	Spotify  *SpotifyClient
+	Playback *PlaybackCache
+	Mutes    *MuteMemory
+
+	queue      *commandQueue
+	coalescer  *coalescer
+	relativeMu sync.Mutex
+	market     marketCache
+	devices    deviceListCache
+}
+
+func NewAPI(spotify *SpotifyClient, playback *PlaybackCache) *API {
+	queue := newCommandQueueFromEnv()
+	return &API{
+		Spotify:   spotify,
+		Playback:  playback,
+		Mutes:     NewMuteMemory(),
+		queue:     queue,
+		coalescer: newCoalescerFromEnv(spotify, queue),
+	}
+}
+
+// RegisterAPIRoutes mounts the player routes on mux.
 func RegisterAPIRoutes(mux *http.ServeMux, spotify *SpotifyClient, playback *PlaybackCache) {
-	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodGet, "/me/player", nil, nil)
-		if status == http.StatusNoContent {
-			if cached, ok := playback.Get(); ok {
-				writeRawJSON(w, http.StatusOK, cached)
-				return
-			}
-			writeJSON(w, http.StatusOK, map[string]any{"active": false})
-			return
-		}
-		if err != nil {
-			if isNoActiveDevice(body, err) {
-				if cached, ok := playback.Get(); ok {
-					writeRawJSON(w, http.StatusOK, cached)
-					return
-				}
-				writeJSON(w, http.StatusOK, map[string]any{"active": false})
-				return
-			}
-			writeSpotifyResponse(w, status, body, err)
-			return
-		}
-		if len(body) > 0 {
-			playback.Set(body)
-		}
-		writeRawJSON(w, status, body)
-	})
+	NewAPI(spotify, playback).Register(mux)
+}
 
-	mux.HandleFunc("/api/queue", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodGet, "/me/player/queue", nil, nil)
-		writeSpotifyResponse(w, status, body, err)
-	})
+func (a *API) Register(mux *http.ServeMux) {
+	registerRoutes(mux, a.Spotify, a.routes())
+}
 
-	mux.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodGet, "/me/player/devices", nil, nil)
-		writeSpotifyResponse(w, status, body, err)
-	})
+func (a *API) routes() []route {
+	return []route{
+		{method: http.MethodGet, path: "/api/state", handler: a.handleState, timeout: readTimeout, needsSpotify: true},
+		{method: http.MethodGet, path: "/api/queue", handler: a.handleQueue, timeout: readTimeout, needsSpotify: true},
+		{method: http.MethodGet, path: "/api/devices", handler: a.handleDevices, timeout: readTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/play", handler: a.handlePlay, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/pause", handler: a.handlePause, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/toggle", handler: a.handleToggle, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/next", handler: a.handleNext, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/previous", handler: a.handlePrevious, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/shuffle", handler: a.handleShuffle, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/repeat", handler: a.handleRepeat, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/volume", handler: a.handleVolume, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/mute", handler: a.handleMute, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/unmute", handler: a.handleUnmute, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/seek", handler: a.handleSeek, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/queue/add", handler: a.handleQueueAdd, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/transfer", handler: a.handleTransfer, timeout: commandTimeout, needsSpotify: true},
+		{method: http.MethodPost, path: "/api/batch", handler: a.handleBatch, timeout: batchTimeout, needsSpotify: true},
+		{method: http.MethodGet, path: "/api/search", handler: a.handleSearch, timeout: readTimeout, needsSpotify: true},
+		{method: http.MethodGet, path: "/api/albums/{id}", handler: a.handleAlbum, timeout: readTimeout, needsSpotify: true},
+		{method: http.MethodGet, path: "/api/artists/{id}", handler: a.handleArtist, timeout: readTimeout, needsSpotify: true},
+	}
+}
 
-	mux.HandleFunc("/api/play", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
+func (a *API) handleState(w http.ResponseWriter, r *http.Request) {
+	status, body, err := a.Spotify.Do(r.Context(), http.MethodGet, "/me/player", nil, nil)
+	if status == http.StatusNoContent || isNoActiveDevice(err) {
+		writeCachedPlayback(w, r, a.Playback)
+		return
+	}
+	if err != nil {
+		if isUpstreamOutage(err) && writeStalePlayback(w, r, a.Playback) {
 			return
 		}
-		var payload struct {
-			ContextURI string         `json:"context_uri"`
-			URIs       []string       `json:"uris"`
-			Offset     map[string]any `json:"offset"`
-			PositionMS *int           `json:"position_ms"`
-			DeviceID   string         `json:"device_id"`
+		writeSpotifyResponse(w, status, body, err)
+		return
+	}
+	annotateSpan(r.Context(), cacheHitAttr(false))
+	if len(body) > 0 {
+		a.Playback.Set(body)
+		// Commands Spotify has not caught up with yet stay projected.
+		if projected, ok := a.Playback.Get(); ok {
+			body = projected
 		}
-		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}
+	writeRawJSON(w, status, body)
+}
 
-		body := map[string]any{}
-		if payload.ContextURI != "" {
-			body["context_uri"] = payload.ContextURI
-		}
-		if len(payload.URIs) > 0 {
-			body["uris"] = payload.URIs
-		}
-		if payload.Offset != nil {
-			body["offset"] = payload.Offset
-		}
-		if payload.PositionMS != nil {
-			body["position_ms"] = *payload.PositionMS
-		}
+func (a *API) handleQueue(w http.ResponseWriter, r *http.Request) {
+	status, body, err := a.Spotify.Do(r.Context(), http.MethodGet, "/me/player/queue", nil, nil)
+	writeSpotifyResponse(w, status, body, err)
+}
 
-		query := url.Values{}
-		if payload.DeviceID != "" {
-			query.Set("device_id", payload.DeviceID)
+func (a *API) handleDevices(w http.ResponseWriter, r *http.Request) {
+	status, body, err := a.Spotify.Do(r.Context(), http.MethodGet, "/me/player/devices", nil, nil)
+	if err == nil {
+		if devices, ok := parseDeviceList(body); ok {
+			a.devices.store(devices)
 		}
+	}
+	writeSpotifyResponse(w, status, body, err)
+}
 
-		status, respBody, err := spotify.Do(r.Context(), http.MethodPut, "/me/player/play", query, body)
-		writeSpotifyResponseWithCache(w, status, respBody, err, playback)
-	})
+func (a *API) handlePlay(w http.ResponseWriter, r *http.Request) {
+	var payload playRequest
+	if apiErr := decodeJSON(w, r, &payload, true); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
 
-	mux.HandleFunc("/api/pause", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodPut, "/me/player/pause", nil, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
+func (a *API) handlePause(w http.ResponseWriter, r *http.Request) {
+	a.execute(w, r, pauseCommand())
+}
 
-	mux.HandleFunc("/api/next", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodPost, "/me/player/next", nil, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
+func (a *API) handleToggle(w http.ResponseWriter, r *http.Request) {
+	a.execute(w, r, toggleCommand())
+}
 
-	mux.HandleFunc("/api/previous", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodPost, "/me/player/previous", nil, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
+func (a *API) handleNext(w http.ResponseWriter, r *http.Request) {
+	a.execute(w, r, nextCommand())
+}
 
-	mux.HandleFunc("/api/shuffle", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		var payload struct {
-			State bool `json:"state"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeJSONError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		query := url.Values{}
-		query.Set("state", boolString(payload.State))
-		status, body, err := spotify.Do(r.Context(), http.MethodPut, "/me/player/shuffle", query, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
-
-	mux.HandleFunc("/api/repeat", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		var payload struct {
-			State string `json:"state"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeJSONError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		if payload.State == "" {
-			payload.State = "off"
-		}
-		query := url.Values{}
-		query.Set("state", payload.State)
-		status, body, err := spotify.Do(r.Context(), http.MethodPut, "/me/player/repeat", query, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
-
-	mux.HandleFunc("/api/volume", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		var payload struct {
-			VolumePercent int `json:"volume_percent"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeJSONError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		query := url.Values{}
-		query.Set("volume_percent", intString(payload.VolumePercent))
-		status, body, err := spotify.Do(r.Context(), http.MethodPut, "/me/player/volume", query, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
-
-	mux.HandleFunc("/api/seek", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		var payload struct {
-			PositionMS int `json:"position_ms"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeJSONError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		query := url.Values{}
-		query.Set("position_ms", intString(payload.PositionMS))
-		status, body, err := spotify.Do(r.Context(), http.MethodPut, "/me/player/seek", query, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
-
-	mux.HandleFunc("/api/queue/add", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		var payload struct {
-			URI      string `json:"uri"`
-			DeviceID string `json:"device_id"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeJSONError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		if payload.URI == "" {
-			writeJSONError(w, http.StatusBadRequest, "missing uri")
-			return
-		}
-		query := url.Values{}
-		query.Set("uri", payload.URI)
-		if payload.DeviceID != "" {
-			query.Set("device_id", payload.DeviceID)
-		}
-		status, body, err := spotify.Do(r.Context(), http.MethodPost, "/me/player/queue", query, nil)
-		writeSpotifyResponseWithCache(w, status, body, err, playback)
-	})
+func (a *API) handlePrevious(w http.ResponseWriter, r *http.Request) {
+	a.execute(w, r, previousCommand())
+}
 
-	mux.HandleFunc("/api/transfer", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		var payload struct {
-			DeviceID string `json:"device_id"`
-			Play     bool   `json:"play"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeJSONError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		if payload.DeviceID == "" {
-			writeJSONError(w, http.StatusBadRequest, "missing device_id")
-			return
-		}
-		body := map[string]any{
-			"device_ids": []string{payload.DeviceID},
-			"play":       payload.Play,
-		}
-		status, respBody, err := spotify.Do(r.Context(), http.MethodPut, "/me/player", nil, body)
-		writeSpotifyResponseWithCache(w, status, respBody, err, playback)
-	})
+func (a *API) handleShuffle(w http.ResponseWriter, r *http.Request) {
+	var payload shuffleRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
 
-	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		if spotify == nil {
-			writeJSONError(w, http.StatusServiceUnavailable, "spotify integration is not configured")
-			return
-		}
-		queryStr := r.URL.Query().Get("q")
-		if queryStr == "" {
-			queryStr = r.URL.Query().Get("query")
-		}
-		if queryStr == "" {
-			writeJSONError(w, http.StatusBadRequest, "missing query")
-			return
-		}
-		limit := r.URL.Query().Get("limit")
-		if limit == "" {
-			limit = "12"
+func (a *API) handleRepeat(w http.ResponseWriter, r *http.Request) {
+	var payload repeatRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+func (a *API) handleVolume(w http.ResponseWriter, r *http.Request) {
+	var payload volumeRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+func (a *API) handleMute(w http.ResponseWriter, r *http.Request) {
+	var payload muteRequest
+	if apiErr := decodeJSON(w, r, &payload, true); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+func (a *API) handleUnmute(w http.ResponseWriter, r *http.Request) {
+	var payload unmuteRequest
+	if apiErr := decodeJSON(w, r, &payload, true); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+func (a *API) handleSeek(w http.ResponseWriter, r *http.Request) {
+	var payload seekRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+func (a *API) handleQueueAdd(w http.ResponseWriter, r *http.Request) {
+	var payload queueAddRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+func (a *API) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	var payload transferRequest
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.executeRequest(w, r, payload)
+}
+
+// commandRequest is a decoded command body that validates into a
+// playerCommand.
+type commandRequest interface {
+	command() (playerCommand, *apiError)
+}
+
+func (a *API) executeRequest(w http.ResponseWriter, r *http.Request, req commandRequest) {
+	cmd, apiErr := req.command()
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.execute(w, r, cmd)
+}
+
+// execute sends cmd to Spotify. Once Spotify accepts it, the response is the
+// cached playback state with the command's effects projected onto it, so
+// clients see the change before the next snapshot; with nothing cached yet
+// Spotify's own response is passed through. With ?wait=confirm the response
+// instead waits for the change to show up in Spotify's state.
+func (a *API) execute(w http.ResponseWriter, r *http.Request, cmd playerCommand) {
+	confirmTimeout, apiErr := parseConfirm(r, cmd)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if cmd.deviceID != "" {
+		annotateSpan(r.Context(), deviceIDAttr(cmd.deviceID))
+	}
+	relative := cmd.relative != nil
+	cmd, apiErr = a.resolve(r.Context(), cmd)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	var before map[string]any
+	if confirmTimeout > 0 && cmd.confirm != nil {
+		before = a.currentState(r)
+	}
+	res := a.send(r.Context(), cmd)
+	writeCommandHeaders(w, res)
+	if res.err != nil {
+		if relative {
+			a.Playback.Retract(cmd.effects)
 		}
-		query := url.Values{}
-		query.Set("q", queryStr)
-		query.Set("type", "track")
-		query.Set("limit", limit)
+		writeSpotifyResponseWithCache(w, r, res.status, res.body, res.err, a.Playback)
+		return
+	}
+	// A coalesced request may have been served by a later value.
+	cmd = res.cmd
+	var projected []byte
+	switch {
+	case len(cmd.effects) > 0:
+		projected, _ = a.Playback.Project(cmd.effects)
+	case cmd.noop():
+		projected, _ = a.Playback.Get()
+	}
+	switch {
+	case confirmTimeout > 0:
+		writeJSON(w, http.StatusOK, a.awaitConfirmation(r, cmd, before, res.sentAt, confirmTimeout))
+	case projected != nil:
+		writeRawJSON(w, http.StatusOK, projected)
+	case cmd.applied != nil:
+		writeJSON(w, http.StatusOK, cmd.applied)
+	default:
+		writeRawJSON(w, res.status, res.body)
+	}
+}
 
-		status, body, err := spotify.Do(r.Context(), http.MethodGet, "/search", query, nil)
-		writeSpotifyResponse(w, status, body, err)
-	})
+// send calls Spotify for cmd through the command queue, merging volume and
+// seek bursts through the coalescer first.
+func (a *API) send(ctx context.Context, cmd playerCommand) commandResult {
+	var res commandResult
+	if cmd.coalesce != "" && a.coalescer != nil {
+		res = a.coalescer.submit(ctx, cmd)
+	} else {
+		res = sendCommand(ctx, a.Spotify, a.queue, cmd)
+	}
+	if res.err == nil && cmd.onSuccess != nil {
+		cmd.onSuccess()
+	}
+	return res
 }
 
 func boolString(v bool) string {
@@ -360,51 +315,82 @@ func writeRawJSON(w http.ResponseWriter, status int, body []byte) {
 
 func writeSpotifyResponse(w http.ResponseWriter, status int, body []byte, err error) {
 	if err != nil {
-		if status >= http.StatusBadRequest && len(body) > 0 {
-			writeRawJSON(w, status, body)
-			return
-		}
-		writeJSONError(w, http.StatusBadGateway, err.Error())
+		writeSpotifyError(w, err)
 		return
 	}
 	writeRawJSON(w, status, body)
 }
 
-func writeSpotifyResponseWithCache(w http.ResponseWriter, status int, body []byte, err error, playback *PlaybackCache) {
-	if err != nil && isNoActiveDevice(body, err) {
-		if cached, ok := playback.Get(); ok {
-			writeRawJSON(w, http.StatusOK, cached)
-			return
-		}
-		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+func errNotConfigured() *apiError {
+	return &apiError{Status: http.StatusServiceUnavailable, Code: "not_configured", Message: "spotify integration is not configured"}
+}
+
+func writeSpotifyError(w http.ResponseWriter, err error) {
+	writeAPIError(w, spotifyAPIError(err))
+}
+
+// spotifyAPIError maps an error from a Spotify call to the API envelope.
+func spotifyAPIError(err error) *apiError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &apiError{Status: http.StatusGatewayTimeout, Code: codeTimeout, Message: "request timed out", Retryable: true}
+	}
+	if spErr, ok := asSpotifyError(err); ok {
+		return spErr.apiError()
+	}
+	return &apiError{Status: http.StatusBadGateway, Code: codeForStatus(http.StatusBadGateway), Message: err.Error()}
+}
+
+func writeSpotifyResponseWithCache(w http.ResponseWriter, r *http.Request, status int, body []byte, err error, playback *PlaybackCache) {
+	if isNoActiveDevice(err) {
+		writeCachedPlayback(w, r, playback)
 		return
 	}
 	writeSpotifyResponse(w, status, body, err)
 }
 
-func isNoActiveDevice(body []byte, err error) bool {
-	if err == nil {
+// writeCachedPlayback serves the last known playback state when Spotify
+// reports no active device.
+func writeCachedPlayback(w http.ResponseWriter, r *http.Request, playback *PlaybackCache) {
+	cached, ok := playback.Get()
+	annotateSpan(r.Context(), cacheHitAttr(ok))
+	if ok {
+		writeRawJSON(w, http.StatusOK, cached)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"active": false})
+}
+
+// writeStalePlayback serves the cached playback state marked with
+// "stale": true while Spotify is unreachable. It reports false when nothing
+// is cached.
+func writeStalePlayback(w http.ResponseWriter, r *http.Request, playback *PlaybackCache) bool {
+	cached, updatedAt, ok := playback.snapshot()
+	if !ok {
 		return false
 	}
-	var payload struct {
-		Error struct {
-			Status  int    `json:"status"`
-			Message string `json:"message"`
-			Reason  string `json:"reason"`
-		} `json:"error"`
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(cached, &state); err != nil {
+		return false
 	}
-	if len(body) > 0 {
-		if jsonErr := json.Unmarshal(body, &payload); jsonErr == nil {
-			if strings.EqualFold(payload.Error.Reason, "NO_ACTIVE_DEVICE") {
-				return true
-			}
-			if strings.Contains(strings.ToLower(payload.Error.Message), "no active device") {
-				return true
-			}
-		}
+	annotateSpan(r.Context(), cacheHitAttr(true))
+	state["stale"] = json.RawMessage("true")
+	if at, err := json.Marshal(updatedAt.UTC()); err == nil {
+		state["stale_since"] = at
 	}
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "no active device")
+	writeJSON(w, http.StatusOK, state)
+	return true
+}
+
+// isUpstreamOutage reports whether err means Spotify could not serve the
+// request at all, as opposed to refusing it.
+func isUpstreamOutage(err error) bool {
+	return hasSpotifyCode(err, codeCircuitOpen) ||
+		hasSpotifyCode(err, codeUpstreamUnavailable) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+func isNoActiveDevice(err error) bool {
+	return hasSpotifyCode(err, codeNoActiveDevice)
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
@@ -414,5 +400,5 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 }
 
 func writeJSONError(w http.ResponseWriter, status int, message string) {
-	writeJSON(w, status, map[string]any{"error": message, "code": status})
+	writeAPIError(w, &apiError{Status: status, Code: codeForStatus(status), Message: message})
 }
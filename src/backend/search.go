@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 12
+	// maxSearchOffset is the deepest page Spotify serves.
+	maxSearchOffset = 1000
+	maxQueryLength  = 256
+
+	// maxTopResults and maxTopPerType bound the merged ranking, so one type
+	// cannot crowd out the others.
+	maxTopResults = 5
+	maxTopPerType = 2
+)
+
+var searchTypes = []string{"track", "album", "artist", "playlist", "show", "episode", "audiobook"}
+
+var defaultSearchTypes = []string{"track", "album", "artist", "playlist"}
+
+type searchResponse struct {
+	Query  string   `json:"query"`
+	Types  []string `json:"types"`
+	Market string   `json:"market,omitempty"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+	// Top merges the best matches of all types; it is only built for the
+	// first page.
+	Top     []catalogItem          `json:"top,omitempty"`
+	Results map[string]catalogPage `json:"results"`
+}
+
+type searchParams struct {
+	query  string
+	types  []string
+	limit  int
+	offset int
+	market string
+}
+
+func (a *API) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params, apiErr := parseSearchParams(r.URL.Query())
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if params.market == "" {
+		params.market = a.profileMarket(r.Context())
+	}
+	query := marketQuery(params.market)
+	query.Set("q", params.query)
+	query.Set("type", strings.Join(params.types, ","))
+	query.Set("limit", strconv.Itoa(params.limit))
+	query.Set("offset", strconv.Itoa(params.offset))
+
+	var raw map[string]spotifyPage
+	if apiErr := a.getJSON(r.Context(), "/search", query, &raw); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	out := searchResponse{
+		Query:   params.query,
+		Types:   params.types,
+		Market:  params.market,
+		Offset:  params.offset,
+		Limit:   params.limit,
+		Results: make(map[string]catalogPage, len(params.types)),
+	}
+	for _, kind := range params.types {
+		page := raw[kind+"s"].normalize(kind, params.offset, params.limit)
+		if page.NextOffset != nil && *page.NextOffset > maxSearchOffset {
+			page.NextOffset = nil
+		}
+		out.Results[kind] = page
+	}
+	if params.offset == 0 {
+		out.Top = rankTopResults(params.query, params.types, out.Results)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func parseSearchParams(values url.Values) (searchParams, *apiError) {
+	params := searchParams{types: defaultSearchTypes}
+	params.query = strings.TrimSpace(values.Get("q"))
+	if params.query == "" {
+		params.query = strings.TrimSpace(values.Get("query"))
+	}
+	if params.query == "" {
+		return params, invalidField("q", "missing query")
+	}
+	if len(params.query) > maxQueryLength {
+		return params, invalidField("q", "query is too long")
+	}
+	if raw := values.Get("type"); raw != "" {
+		types, apiErr := parseSearchTypes(raw)
+		if apiErr != nil {
+			return params, apiErr
+		}
+		params.types = types
+	}
+	var apiErr *apiError
+	if params.limit, params.offset, apiErr = parsePage(values, defaultSearchLimit, maxSearchOffset); apiErr != nil {
+		return params, apiErr
+	}
+	if params.market, apiErr = parseMarket(values); apiErr != nil {
+		return params, apiErr
+	}
+	return params, nil
+}
+
+// parseSearchTypes parses a comma-separated type list, dropping duplicates
+// but keeping the caller's order.
+func parseSearchTypes(raw string) ([]string, *apiError) {
+	var types []string
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		kind := strings.ToLower(strings.TrimSpace(part))
+		if !containsString(searchTypes, kind) {
+			return nil, invalidField("type", "type must be a comma-separated list of %s", strings.Join(searchTypes, ", "))
+		}
+		if !seen[kind] {
+			seen[kind] = true
+			types = append(types, kind)
+		}
+	}
+	return types, nil
+}
+
+// rankTopResults merges the pages into one ranking. Spotify orders each
+// page by relevance, so an item's rank within its type is the base score;
+// name matches and popularity break ties between types.
+func rankTopResults(query string, types []string, pages map[string]catalogPage) []catalogItem {
+	type scored struct {
+		item  catalogItem
+		score float64
+	}
+	needle := strings.ToLower(query)
+	var candidates []scored
+	for _, kind := range types {
+		for rank, item := range pages[kind].Items {
+			score := 1 / float64(rank+1)
+			name := strings.ToLower(strings.TrimSpace(item.Name))
+			switch {
+			case name == needle:
+				score += 1
+			case strings.HasPrefix(name, needle):
+				score += 0.5
+			case strings.Contains(name, needle):
+				score += 0.25
+			}
+			score += float64(item.Popularity) / 400
+			candidates = append(candidates, scored{item: item, score: score})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	top := []catalogItem{}
+	perType := map[string]int{}
+	for _, c := range candidates {
+		if len(top) == maxTopResults {
+			break
+		}
+		if perType[c.item.Type] == maxTopPerType {
+			continue
+		}
+		perType[c.item.Type]++
+		top = append(top, c.item)
+	}
+	return top
+}
@@ -2,9 +2,11 @@ package backend
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -18,10 +20,13 @@ type SecretsAPI struct {
 	Store   *SecretStore
 	Specs   []SecretSpec
 	Admin   *AdminAuth
+	Audit   *AuditLog
 	Allowed map[string]SecretSpec
+	// OnChange is called after secrets were written or deleted.
+	OnChange func()
 }
 
-func NewSecretsAPI(store *SecretStore, specs []SecretSpec, admin *AdminAuth) *SecretsAPI {
+func NewSecretsAPI(store *SecretStore, specs []SecretSpec, admin *AdminAuth, audit *AuditLog) *SecretsAPI {
 	allowed := map[string]SecretSpec{}
 	for _, spec := range specs {
 		key := strings.TrimSpace(spec.Key)
@@ -30,11 +35,13 @@ func NewSecretsAPI(store *SecretStore, specs []SecretSpec, admin *AdminAuth) *Se
 		}
 		allowed[key] = spec
 	}
-	return &SecretsAPI{Store: store, Specs: specs, Admin: admin, Allowed: allowed}
+	return &SecretsAPI{Store: store, Specs: specs, Admin: admin, Audit: audit, Allowed: allowed}
 }
 
 func (s *SecretsAPI) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/admin/secrets", s.handleSecrets)
+	mux.HandleFunc("/api/admin/secrets/test", s.handleTest)
+	mux.HandleFunc("/api/admin/secrets/", s.handleSecretKey)
 }
 
 func (s *SecretsAPI) handleSecrets(w http.ResponseWriter, r *http.Request) {
@@ -55,29 +62,150 @@ func (s *SecretsAPI) handleSecrets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method != http.MethodPut {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		methodNotAllowed([]string{http.MethodGet, http.MethodPut}).ServeHTTP(w, r)
 		return
 	}
 	var payload struct {
 		Secrets map[string]string `json:"secrets"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "invalid json")
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
 	filtered := map[string]string{}
+	keys := []string{}
 	for key, value := range payload.Secrets {
 		if _, ok := s.Allowed[key]; ok {
 			filtered[key] = value
+			if strings.TrimSpace(value) != "" {
+				keys = append(keys, key)
+			}
 		}
 	}
+	sort.Strings(keys)
+	entry := newAuditEntry(r, s.Admin, "secrets.set")
+	entry.Params = map[string]any{"keys": keys}
 	if err := s.Store.Set(filtered); err != nil {
+		s.audit(entry, http.StatusInternalServerError, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.audit(entry, http.StatusOK, "ok")
+	s.changed()
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+func (s *SecretsAPI) handleSecretKey(w http.ResponseWriter, r *http.Request) {
+	if s == nil || s.Admin == nil || !s.Admin.RequireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		methodNotAllowed([]string{http.MethodDelete}).ServeHTTP(w, r)
+		return
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/admin/secrets/"))
+	if _, ok := s.Allowed[key]; !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown secret")
+		return
+	}
+	entry := newAuditEntry(r, s.Admin, "secrets.delete")
+	entry.Params = map[string]any{"key": key}
+	if err := s.Store.Delete(key); err != nil {
+		s.audit(entry, http.StatusInternalServerError, err.Error())
 		writeJSONError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	s.audit(entry, http.StatusOK, "ok")
+	s.changed()
 	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
 }
 
+func (s *SecretsAPI) handleTest(w http.ResponseWriter, r *http.Request) {
+	if s == nil || s.Admin == nil || !s.Admin.RequireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed([]string{http.MethodPost}).ServeHTTP(w, r)
+		return
+	}
+	var payload struct {
+		Secrets map[string]string `json:"secrets"`
+	}
+	if apiErr := decodeJSON(w, r, &payload, false); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	// Candidates fall back to the credentials the client runs with, resolved
+	// like loadSpotifyCredentials: the environment first, then the secrets
+	// file. That way a single secret can be tested against the rest of the
+	// live configuration.
+	stored, err := s.Store.Values()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	values := map[string]string{}
+	for _, key := range []string{"SPOTIFY_CLIENT_ID", "SPOTIFY_CLIENT_SECRET", "SPOTIFY_REFRESH_TOKEN"} {
+		values[key] = Getenv(key, strings.TrimSpace(stored[key]))
+	}
+	// Only a refresh token read from the file can be written back there;
+	// the environment takes precedence over it.
+	storedRefresh := ""
+	if Getenv("SPOTIFY_REFRESH_TOKEN", "") == "" {
+		storedRefresh = values["SPOTIFY_REFRESH_TOKEN"]
+	}
+	for key, value := range payload.Secrets {
+		if _, ok := s.Allowed[key]; !ok {
+			continue
+		}
+		if v := strings.TrimSpace(value); v != "" {
+			values[key] = v
+		}
+	}
+	result := CheckSpotifyCredentials(r.Context(), values["SPOTIFY_CLIENT_ID"], values["SPOTIFY_CLIENT_SECRET"], values["SPOTIFY_REFRESH_TOKEN"])
+	entry := newAuditEntry(r, s.Admin, "secrets.test")
+	entry.Params = map[string]any{"product": result.Product, "scopes": result.Scopes}
+	// Exchanging the stored refresh token may rotate it, which would leave
+	// the live client holding a dead token. Write the new one back, the same
+	// way the client does after its own refreshes.
+	if result.rotatedRefresh != "" && storedRefresh != "" && values["SPOTIFY_REFRESH_TOKEN"] == storedRefresh {
+		entry.Params["refresh_token_rotated"] = true
+		if err := s.Store.Set(map[string]string{"SPOTIFY_REFRESH_TOKEN": result.rotatedRefresh}); err != nil {
+			s.audit(entry, http.StatusInternalServerError, err.Error())
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.changed()
+	}
+	if result.OK {
+		s.audit(entry, http.StatusOK, "ok")
+	} else {
+		s.audit(entry, http.StatusOK, result.Error)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *SecretsAPI) changed() {
+	if s.OnChange != nil {
+		s.OnChange()
+	}
+}
+
+func (s *SecretsAPI) audit(entry AuditEntry, status int, result string) {
+	entry.Status = status
+	entry.Result = result
+	s.Audit.Record(entry)
+}
+
+// ManifestVersion returns the integration version declared in the manifest.
+func ManifestVersion(manifestJSON []byte) string {
+	var payload struct {
+		Version string `json:"version"`
+	}
+	_ = json.Unmarshal(manifestJSON, &payload)
+	return strings.TrimSpace(payload.Version)
+}
+
 func ParseSecretSpecs(manifestJSON []byte) []SecretSpec {
 	var payload struct {
 		Secrets []json.RawMessage `json:"secrets"`
@@ -166,6 +294,47 @@ func (s *SecretStore) Set(values map[string]string) error {
 	return s.saveUnlocked(current)
 }
 
+func (s *SecretStore) Values() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadUnlocked()
+}
+
+func (s *SecretStore) Delete(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.loadUnlocked()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(current, strings.TrimSpace(key))
+	}
+	return s.saveUnlocked(current)
+}
+
+// Check reports whether the secrets file can be read and parsed. A missing
+// file is fine: credentials may come from the environment.
+func (s *SecretStore) Check() error {
+	if s == nil || strings.TrimSpace(s.path) == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("secrets file is not a JSON object: %w", err)
+	}
+	return nil
+}
+
 func (s *SecretStore) loadUnlocked() (map[string]string, error) {
 	if strings.TrimSpace(s.path) == "" {
 		return map[string]string{}, nil
@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testAdmin returns admin auth with a fresh key and a token it accepts.
+func testAdmin(t *testing.T) (*AdminAuth, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, Claims{Role: "admin"}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AdminAuth{pubKey: &key.PublicKey, enabled: true}, token
+}
+
+func TestSecretsTestPrefersEnvironment(t *testing.T) {
+	var gotAuth, gotRefresh string
+	stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/token" {
+			_ = r.ParseForm()
+			gotAuth, gotRefresh = r.Header.Get("Authorization"), r.PostForm.Get("refresh_token")
+			fmt.Fprint(w, `{"access_token":"access","token_type":"Bearer","expires_in":3600,"scope":""}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"alice","product":"premium"}`)
+	}))
+	store := NewSecretStore(filepath.Join(t.TempDir(), "secrets.json"))
+	if err := store.Set(map[string]string{
+		"SPOTIFY_CLIENT_ID":     "file-client",
+		"SPOTIFY_CLIENT_SECRET": "file-secret",
+		"SPOTIFY_REFRESH_TOKEN": "file-refresh",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SPOTIFY_CLIENT_ID", "env-client")
+	t.Setenv("SPOTIFY_CLIENT_SECRET", "")
+	t.Setenv("SPOTIFY_REFRESH_TOKEN", "")
+	admin, token := testAdmin(t)
+	s := &SecretsAPI{Store: store, Admin: admin}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/admin/secrets/test", strings.NewReader(`{"secrets":{}}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.handleTest(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", w.Code, w.Body)
+	}
+	// The client ID comes from the environment, like the running client's;
+	// the rest falls back to the secrets file.
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("env-client:file-secret")); gotAuth != want {
+		t.Errorf("token request authorized as %q, want env-client:file-secret", gotAuth)
+	}
+	if gotRefresh != "file-refresh" {
+		t.Errorf("refresh token = %q, want file-refresh", gotRefresh)
+	}
+}
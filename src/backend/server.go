@@ -3,7 +3,12 @@ package backend
 import (
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/homenavi/spotify-integration/internal/tracing"
 )
 
 type Server struct {
@@ -12,9 +17,12 @@ type Server struct {
 	ManifestJSON []byte
 	Spotify      *SpotifyClient
 	Playback     *PlaybackCache
+	Mutes        *MuteMemory
 	SecretStore  *SecretStore
 	SecretSpecs  []SecretSpec
 	AdminAuth    *AdminAuth
+	Audit        *AuditLog
+	Images       *ImageProxy
 }
 
 func mustSub(fsys fs.FS, dir string) fs.FS {
@@ -28,20 +36,21 @@ func mustSub(fsys fs.FS, dir string) fs.FS {
 func (s *Server) Routes() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
-
-	mux.HandleFunc("/.well-known/homenavi-integration.json", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(s.ManifestJSON)
-	})
-
-	RegisterAPIRoutes(mux, s.Spotify, s.Playback)
+	registerRoutes(mux, s.Spotify, s.routes())
+	api := NewAPI(s.Spotify, s.Playback)
+	if s.Mutes != nil {
+		api.Mutes = s.Mutes
+	}
+	api.Register(mux)
 	if s.SecretStore != nil {
-		NewSecretsAPI(s.SecretStore, s.SecretSpecs, s.AdminAuth).Register(mux)
+		secretsAPI := NewSecretsAPI(s.SecretStore, s.SecretSpecs, s.AdminAuth, s.Audit)
+		if s.Spotify != nil {
+			secretsAPI.OnChange = s.reloadSpotifyCredentials
+		}
+		secretsAPI.Register(mux)
+	}
+	if s.Audit != nil {
+		NewAuditAPI(s.Audit, s.AdminAuth).Register(mux)
 	}
 
 	assets := http.FileServer(http.FS(mustSub(s.WebFS, "assets")))
@@ -54,10 +63,40 @@ func (s *Server) Routes() http.Handler {
 	mux.Handle("/widgets/", http.StripPrefix("/widgets/", widgets))
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		_, _ = io.WriteString(w, "not found")
 	})
 
 	s.Mux = mux
-	return mux
+	return recoverPanics(AuditMiddleware(s.Audit, s.AdminAuth, tracing.Routes(mux)))
+}
+
+func (s *Server) routes() []route {
+	routes := []route{
+		{method: http.MethodGet, path: "/healthz", handler: s.handleHealthz},
+		{method: http.MethodGet, path: "/readyz", handler: s.handleReadyz},
+		{method: http.MethodGet, path: "/.well-known/homenavi-integration.json", handler: s.handleManifest},
+		{method: http.MethodGet, path: "/api/auth/status", handler: s.handleAuthStatus},
+		{method: http.MethodGet, path: "/api/admin/status", handler: s.handleAdminStatus},
+	}
+	if s.Images != nil {
+		routes = append(routes, route{method: http.MethodGet, path: "/api/image", handler: s.Images.ServeHTTP, timeout: 15 * time.Second})
+	}
+	return routes
+}
+
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(s.ManifestJSON)
+}
+
+func (s *Server) reloadSpotifyCredentials() {
+	if err := s.Spotify.ReloadCredentials(); err != nil {
+		slog.Error("reload spotify credentials", "err", err)
+	}
 }
@@ -1,39 +1,158 @@
 package backend
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/homenavi/spotify-integration/internal/logging"
 )
 
-const spotifyAPIBase = "https://api.spotify.com/v1"
-const spotifyTokenURL = "https://accounts.spotify.com/api/token" // #nosec G101 -- URL, not a credential
+// The Spotify endpoints are variables so tests can point them at a stub.
+var (
+	spotifyAPIBase  = "https://api.spotify.com/v1"
+	spotifyTokenURL = "https://accounts.spotify.com/api/token" // #nosec G101 -- URL, not a credential
+)
 
 type SpotifyClient struct {
 	clientID     string
 	clientSecret string
 	refreshToken string
+	// sourceRefresh is the configured refresh token; refreshToken diverges
+	// from it once Spotify rotates the token.
+	sourceRefresh string
+
+	store *SecretStore
+	cache *tokenCache
+	wake  chan struct{}
 
 	httpClient *http.Client
-	mu         sync.Mutex
-	accessTok  string
-	expiresAt  time.Time
+	breakers   *breakers
+
+	// token is the published access token. The request path reads it
+	// without taking mu.
+	token atomic.Pointer[accessToken]
+
+	mu sync.Mutex
+	// generation is bumped whenever the credentials change, so a refresh
+	// started with the old credentials does not publish its result.
+	generation uint64
+	flight     *refreshCall
+
+	// reauthErr is set when the token endpoint rejects the grant itself,
+	// or the Web API rejects a freshly refreshed access token. It is
+	// sticky: no further refreshes are attempted until the credentials
+	// are reloaded.
+	reauthErr   *tokenError
+	reauthSince time.Time
+	lastRefresh time.Time
+	// refreshErr is the most recent failed refresh; it is cleared by the
+	// next successful one.
+	refreshErr   string
+	refreshErrAt time.Time
+
+	upstreamMu    sync.Mutex
+	lastSuccess   time.Time
+	lastUpstream  *UpstreamError
+	cooldownUntil time.Time
 }
 
-func NewSpotifyClientFromEnv() (*SpotifyClient, error) {
-	clientID := strings.TrimSpace(getenv("SPOTIFY_CLIENT_ID", ""))
-	clientSecret := strings.TrimSpace(getenv("SPOTIFY_CLIENT_SECRET", ""))
-	refreshToken := strings.TrimSpace(getenv("SPOTIFY_REFRESH_TOKEN", ""))
+const (
+	AuthStateOK            = "ok"
+	AuthStateNeedsReauth   = "needs_reauth"
+	AuthStateNotConfigured = "not_configured"
+)
+
+type AuthStatus struct {
+	State          string     `json:"state"`
+	Reason         string     `json:"reason,omitempty"`
+	Since          *time.Time `json:"since,omitempty"`
+	LastRefresh    *time.Time `json:"last_refresh,omitempty"`
+	TokenExpiresAt *time.Time `json:"token_expires_at,omitempty"`
+	RefreshError   string     `json:"refresh_error,omitempty"`
+	RefreshErrorAt *time.Time `json:"refresh_error_at,omitempty"`
+}
+
+// UpstreamError describes the most recent failed Spotify Web API call.
+type UpstreamError struct {
+	Code           string    `json:"code"`
+	Message        string    `json:"message"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	At             time.Time `json:"at"`
+}
+
+// UpstreamStatus summarizes recent Spotify Web API calls.
+type UpstreamStatus struct {
+	LastSuccess      *time.Time     `json:"last_success,omitempty"`
+	LastError        *UpstreamError `json:"last_error,omitempty"`
+	RateLimitedUntil *time.Time     `json:"rate_limited_until,omitempty"`
+	CooldownMS       int64          `json:"cooldown_ms"`
+}
+
+// NewSpotifyClientFromEnv builds a client from the environment or secrets
+// file. Rotated refresh tokens are written back to store when it is non-nil.
+func NewSpotifyClientFromEnv(store *SecretStore) (*SpotifyClient, error) {
+	clientID, clientSecret, refreshToken, err := loadSpotifyCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SpotifyClient{
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		refreshToken:  refreshToken,
+		sourceRefresh: refreshToken,
+		store:         store,
+		cache:         newTokenCacheFromEnv(),
+		wake:          make(chan struct{}, 1),
+		breakers:      newBreakersFromEnv(),
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+	c.restoreCachedToken()
+	return c, nil
+}
+
+// restoreCachedToken adopts the cached access token and rotated refresh
+// token when they belong to the configured credentials.
+func (c *SpotifyClient) restoreCachedToken() {
+	cached, ok := c.cache.load()
+	if !ok || cached.ClientID != c.clientID {
+		return
+	}
+	if cached.SourceSHA256 != tokenFingerprint(c.sourceRefresh) && cached.RefreshToken != c.sourceRefresh {
+		return
+	}
+	if cached.RefreshToken != "" {
+		c.refreshToken = cached.RefreshToken
+	}
+	if cached.AccessToken != "" && time.Now().Before(cached.ExpiresAt) {
+		c.token.Store(&accessToken{value: cached.AccessToken, expiresAt: cached.ExpiresAt})
+	}
+}
+
+func loadSpotifyCredentials() (clientID, clientSecret, refreshToken string, err error) {
+	clientID = strings.TrimSpace(Getenv("SPOTIFY_CLIENT_ID", ""))
+	clientSecret = strings.TrimSpace(Getenv("SPOTIFY_CLIENT_SECRET", ""))
+	refreshToken = strings.TrimSpace(Getenv("SPOTIFY_REFRESH_TOKEN", ""))
 	if clientID == "" || clientSecret == "" || refreshToken == "" {
 		secrets := loadSecretsFromFile(selectSecretsPath(), "spotify")
 		if clientID == "" {
@@ -48,15 +167,152 @@ func NewSpotifyClientFromEnv() (*SpotifyClient, error) {
 	}
 
 	if clientID == "" || clientSecret == "" || refreshToken == "" {
-		return nil, errors.New("missing SPOTIFY_CLIENT_ID, SPOTIFY_CLIENT_SECRET, or SPOTIFY_REFRESH_TOKEN")
+		return "", "", "", errors.New("missing SPOTIFY_CLIENT_ID, SPOTIFY_CLIENT_SECRET, or SPOTIFY_REFRESH_TOKEN")
+	}
+	return clientID, clientSecret, refreshToken, nil
+}
+
+// ReloadCredentials re-reads the credentials from the environment and the
+// secrets file. When they changed, the cached token and any needs_reauth
+// state are dropped so the next request refreshes with the new values. A
+// needs_reauth caused by a rejected access token is dropped even when they
+// did not change, since the grant itself was never refused.
+func (c *SpotifyClient) ReloadCredentials() error {
+	if c == nil {
+		return errors.New("spotify client is nil")
+	}
+	clientID, clientSecret, refreshToken, err := loadSpotifyCredentials()
+	if err != nil {
+		return err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A rotated token written back to the store shows up here as the
+	// current refresh token; that is not a credential change.
+	if clientID == c.clientID && clientSecret == c.clientSecret && (refreshToken == c.sourceRefresh || refreshToken == c.refreshToken) {
+		if c.reauthErr != nil && c.reauthErr.Code == "invalid_token" {
+			c.reauthErr = nil
+			c.reauthSince = time.Time{}
+			c.signalWake()
+		}
+		return nil
+	}
+	c.clientID, c.clientSecret, c.refreshToken = clientID, clientSecret, refreshToken
+	c.sourceRefresh = refreshToken
+	c.generation++
+	c.token.Store(nil)
+	c.reauthErr = nil
+	c.reauthSince = time.Time{}
+	c.signalWake()
+	return nil
+}
 
-	return &SpotifyClient{
-		clientID:     clientID,
-		clientSecret: clientSecret,
-		refreshToken: refreshToken,
-		httpClient:   &http.Client{Timeout: 10 * time.Second},
-	}, nil
+// AuthStatus reports whether the client can currently obtain access tokens.
+func (c *SpotifyClient) AuthStatus() AuthStatus {
+	if c == nil {
+		return AuthStatus{State: AuthStateNotConfigured}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := AuthStatus{State: AuthStateOK}
+	if !c.lastRefresh.IsZero() {
+		t := c.lastRefresh
+		out.LastRefresh = &t
+	}
+	if c.reauthErr != nil {
+		since := c.reauthSince
+		out.State = AuthStateNeedsReauth
+		out.Reason = c.reauthErr.Error()
+		out.Since = &since
+	}
+	if c.refreshErr != "" {
+		at := c.refreshErrAt
+		out.RefreshError = c.refreshErr
+		out.RefreshErrorAt = &at
+	}
+	if tok := c.token.Load(); tok != nil {
+		exp := tok.expiresAt
+		out.TokenExpiresAt = &exp
+	}
+	return out
+}
+
+// UpstreamStatus reports the last Web API success and failure and any
+// rate-limit cooldown Spotify asked for.
+func (c *SpotifyClient) UpstreamStatus() UpstreamStatus {
+	var out UpstreamStatus
+	if c == nil {
+		return out
+	}
+	c.upstreamMu.Lock()
+	defer c.upstreamMu.Unlock()
+	if !c.lastSuccess.IsZero() {
+		t := c.lastSuccess
+		out.LastSuccess = &t
+	}
+	if c.lastUpstream != nil {
+		e := *c.lastUpstream
+		out.LastError = &e
+	}
+	if remaining := time.Until(c.cooldownUntil); remaining > 0 {
+		until := c.cooldownUntil
+		out.RateLimitedUntil = &until
+		out.CooldownMS = remaining.Milliseconds()
+	}
+	return out
+}
+
+// BreakerStatus reports the circuit breaker of every endpoint family that
+// has been used.
+func (c *SpotifyClient) BreakerStatus() []BreakerStatus {
+	if c == nil {
+		return nil
+	}
+	return c.breakers.status()
+}
+
+// restoreUpstream loads diagnostics saved before a restart, so a pending
+// rate-limit cooldown is still reported.
+func (c *SpotifyClient) restoreUpstream(saved UpstreamStatus) {
+	if c == nil {
+		return
+	}
+	c.upstreamMu.Lock()
+	defer c.upstreamMu.Unlock()
+	if saved.LastSuccess != nil && c.lastSuccess.IsZero() {
+		c.lastSuccess = *saved.LastSuccess
+	}
+	if saved.LastError != nil && c.lastUpstream == nil {
+		e := *saved.LastError
+		c.lastUpstream = &e
+	}
+	if saved.RateLimitedUntil != nil && saved.RateLimitedUntil.After(c.cooldownUntil) {
+		c.cooldownUntil = *saved.RateLimitedUntil
+	}
+}
+
+func (c *SpotifyClient) recordUpstream(err error) {
+	now := time.Now()
+	c.upstreamMu.Lock()
+	defer c.upstreamMu.Unlock()
+	if err == nil {
+		c.lastSuccess = now
+		return
+	}
+	spErr, ok := asSpotifyError(err)
+	if !ok {
+		return
+	}
+	c.lastUpstream = &UpstreamError{
+		Code:           spErr.Code,
+		Message:        spErr.Message,
+		UpstreamStatus: spErr.UpstreamStatus,
+		Reason:         spErr.Reason,
+		At:             now,
+	}
+	if spErr.Code == codeRateLimited && spErr.RetryAfter > 0 {
+		c.cooldownUntil = now.Add(spErr.RetryAfter)
+	}
 }
 
 func loadSecretsFromFile(path, integrationID string) map[string]string {
@@ -89,14 +345,12 @@ func selectSecretsPath() string {
 	return filepath.Join("config", "integration.secrets.json")
 }
 
+// Do calls the Spotify Web API. Failures are always returned as a
+// *SpotifyError; the raw response body is returned alongside it.
 func (c *SpotifyClient) Do(ctx context.Context, method, path string, query url.Values, body any) (int, []byte, error) {
 	if c == nil {
 		return 0, nil, errors.New("spotify client is nil")
 	}
-	token, err := c.ensureToken(ctx)
-	if err != nil {
-		return 0, nil, err
-	}
 
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
@@ -106,27 +360,130 @@ func (c *SpotifyClient) Do(ctx context.Context, method, path string, query url.V
 		endpoint = endpoint + "?" + query.Encode()
 	}
 
-	var bodyReader io.Reader
+	var payload []byte
 	if body != nil {
-		payload, err := json.Marshal(body)
+		var err error
+		payload, err = json.Marshal(body)
 		if err != nil {
 			return 0, nil, fmt.Errorf("marshal request: %w", err)
 		}
-		bodyReader = strings.NewReader(string(payload))
 	}
 
+	ctx, span := tracer.Start(ctx, "spotify "+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(method),
+			attribute.String("spotify.path", path),
+		))
+	defer span.End()
+	if id := query.Get("device_id"); id != "" {
+		span.SetAttributes(deviceIDAttr(id))
+	}
+
+	start := time.Now()
+	family := endpointFamily(path)
+	if err := c.breakers.allow(family); err != nil {
+		endUpstreamSpan(span, 0, err)
+		logUpstream(ctx, method, path, 0, start, err)
+		return 0, nil, err
+	}
+	token, err := c.ensureToken(ctx)
+	if err != nil {
+		c.breakers.record(family, outcomeIgnored)
+		err = tokenFailure(err)
+		endUpstreamSpan(span, 0, err)
+		logUpstream(ctx, method, path, 0, start, err)
+		return 0, nil, err
+	}
+	status, data, err := c.do(ctx, method, endpoint, payload, token)
+	// A 401 usually means the access token expired early or was rotated;
+	// refresh once and retry before reporting the grant as revoked.
+	if hasSpotifyCode(err, codeTokenRevoked) && status == http.StatusUnauthorized {
+		c.invalidateToken(token)
+		span.SetAttributes(attribute.Bool("spotify.retried_after_401", true))
+		if token, err = c.ensureToken(ctx); err != nil {
+			c.breakers.record(family, outcomeIgnored)
+			err = tokenFailure(err)
+			endUpstreamSpan(span, 0, err)
+			logUpstream(ctx, method, path, 0, start, err)
+			return 0, nil, err
+		}
+		status, data, err = c.do(ctx, method, endpoint, payload, token)
+		if hasSpotifyCode(err, codeTokenRevoked) && status == http.StatusUnauthorized {
+			c.rejectToken(token)
+		}
+	}
+	c.breakers.record(family, breakerOutcomeFor(ctx, err))
+	c.recordUpstream(err)
+	endUpstreamSpan(span, status, err)
+	logUpstream(ctx, method, path, status, start, err)
+	return status, data, err
+}
+
+func endUpstreamSpan(span trace.Span, status int, err error) {
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	if err == nil {
+		return
+	}
+	if spErr, ok := asSpotifyError(err); ok {
+		span.SetAttributes(attribute.String("spotify.error_code", spErr.Code))
+		if spErr.Reason != "" {
+			span.SetAttributes(attribute.String("spotify.error_reason", spErr.Reason))
+		}
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// logUpstream logs one Web API call. Successful calls are logged at debug
+// level since the player polls /me/player continuously.
+func logUpstream(ctx context.Context, method, path string, status int, start time.Time, err error) {
+	attrs := []slog.Attr{
+		slog.String("method", method),
+		slog.String("path", path),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", logging.Millis(time.Since(start))),
+	}
+	if err == nil {
+		slog.LogAttrs(ctx, slog.LevelDebug, "spotify request", attrs...)
+		return
+	}
+	level := slog.LevelWarn
+	if spErr, ok := asSpotifyError(err); ok {
+		attrs = append(attrs, slog.String("code", spErr.Code))
+		if spErr.Reason != "" {
+			attrs = append(attrs, slog.String("reason", spErr.Reason))
+		}
+		if spErr.UpstreamRequestID != "" {
+			attrs = append(attrs, slog.String("upstream_request_id", spErr.UpstreamRequestID))
+		}
+		// Expected player conditions are not worth a warning.
+		if spErr.Code == codeNoActiveDevice || spErr.Code == codeRestrictionViolated {
+			level = slog.LevelInfo
+		}
+	}
+	attrs = append(attrs, slog.String("err", err.Error()))
+	slog.LogAttrs(ctx, level, "spotify request failed", attrs...)
+}
+
+func (c *SpotifyClient) do(ctx context.Context, method, endpoint string, payload []byte, token string) (int, []byte, error) {
+	var bodyReader io.Reader
+	if payload != nil {
+		bodyReader = bytes.NewReader(payload)
+	}
 	req, err := http.NewRequestWithContext(ctx, method, endpoint, bodyReader)
 	if err != nil {
 		return 0, nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
-	if body != nil {
+	if payload != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, transportError(err)
 	}
 	defer resp.Body.Close()
 
@@ -136,86 +493,88 @@ func (c *SpotifyClient) Do(ctx context.Context, method, path string, query url.V
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return resp.StatusCode, nil, err
+		return resp.StatusCode, nil, transportError(err)
 	}
 	if resp.StatusCode >= 400 {
-		return resp.StatusCode, data, fmt.Errorf("spotify api error: %s", strings.TrimSpace(string(data)))
+		return resp.StatusCode, data, classifySpotifyError(resp.StatusCode, resp.Header, data)
 	}
 	return resp.StatusCode, data, nil
 }
 
-func (c *SpotifyClient) ensureToken(ctx context.Context) (string, error) {
-	c.mu.Lock()
-	if c.accessTok != "" && time.Now().Before(c.expiresAt.Add(-30*time.Second)) {
-		tok := c.accessTok
-		c.mu.Unlock()
-		return tok, nil
-	}
-	c.mu.Unlock()
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token"`
+}
 
-	if err := c.refreshAccessToken(ctx); err != nil {
-		return "", err
-	}
+// tokenError is the OAuth error body returned by the Spotify token endpoint.
+type tokenError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	// RetryAfter is the token endpoint's Retry-After, if any.
+	RetryAfter time.Duration `json:"-"`
+}
 
-	c.mu.Lock()
-	tok := c.accessTok
-	c.mu.Unlock()
-	return tok, nil
+func (e *tokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("refresh token error: %s: %s", e.Code, e.Description)
+	}
+	if e.Code != "" {
+		return "refresh token error: " + e.Code
+	}
+	return fmt.Sprintf("refresh token error: status %d", e.Status)
 }
 
-func (c *SpotifyClient) refreshAccessToken(ctx context.Context) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// needsReauth reports whether the token endpoint rejected the grant or the
+// client itself, or the Web API rejected the tokens it issued (see
+// rejectToken), which retrying cannot fix.
+func (e *tokenError) needsReauth() bool {
+	return e.Code == "invalid_grant" || e.Code == "invalid_client" || e.Code == "invalid_token"
+}
 
+func requestToken(ctx context.Context, httpClient *http.Client, clientID, clientSecret, refreshToken string) (tokenResponse, error) {
 	form := url.Values{}
 	form.Set("grant_type", "refresh_token")
-	form.Set("refresh_token", c.refreshToken)
+	form.Set("refresh_token", refreshToken)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, spotifyTokenURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		return err
+		return tokenResponse{}, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	auth := base64.StdEncoding.EncodeToString([]byte(c.clientID + ":" + c.clientSecret))
+	auth := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret))
 	req.Header.Set("Authorization", "Basic "+auth)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return tokenResponse{}, err
 	}
 	defer resp.Body.Close()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return tokenResponse{}, err
 	}
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("refresh token error: %s", strings.TrimSpace(string(data)))
+		tokErr := &tokenError{Status: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		if jsonErr := json.Unmarshal(data, tokErr); jsonErr != nil || tokErr.Code == "" {
+			tokErr.Description = strings.TrimSpace(string(data))
+		}
+		return tokenResponse{}, tokErr
 	}
 
-	var parsed struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
-		TokenType   string `json:"token_type"`
-	}
+	var parsed tokenResponse
 	if err := json.Unmarshal(data, &parsed); err != nil {
-		return err
+		return tokenResponse{}, err
 	}
 	if parsed.AccessToken == "" {
-		return errors.New("missing access_token in refresh response")
+		return tokenResponse{}, errors.New("missing access_token in refresh response")
 	}
-	c.accessTok = parsed.AccessToken
 	if parsed.ExpiresIn <= 0 {
 		parsed.ExpiresIn = 3600
 	}
-	c.expiresAt = time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
-	return nil
-}
-
-func getenv(key, fallback string) string {
-	value := strings.TrimSpace(os.Getenv(key))
-	if value == "" {
-		return fallback
-	}
-	return value
+	return parsed, nil
 }
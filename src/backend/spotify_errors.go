@@ -0,0 +1,253 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stable error codes returned to API clients for Spotify failures.
+const (
+	codePremiumRequired     = "premium_required"
+	codeNoActiveDevice      = "no_active_device"
+	codeRateLimited         = "rate_limited"
+	codeTokenRevoked        = "token_revoked"
+	codeDeviceNotFound      = "device_not_found"
+	codeRestrictionViolated = "restriction_violated"
+	codeUpstreamUnavailable = "upstream_unavailable"
+	codeUpstreamError       = "upstream_error"
+	codeCircuitOpen         = "circuit_open"
+	codeQueueFull           = "queue_full"
+	codeInvalidRequest      = "invalid_request"
+	codeNotFound            = "not_found"
+	codeTimeout             = "timeout"
+	codeCredentialsChanged  = "credentials_changed"
+)
+
+// SpotifyError is the typed error returned by SpotifyClient.Do for every
+// failed upstream call.
+type SpotifyError struct {
+	Code    string
+	Message string
+	// Status is the HTTP status this integration answers with.
+	Status int
+	// UpstreamStatus is the status Spotify returned, or 0 when no response
+	// was received.
+	UpstreamStatus    int
+	Reason            string
+	Retryable         bool
+	RetryAfter        time.Duration
+	UpstreamRequestID string
+	Err               error
+}
+
+func (e *SpotifyError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("spotify api error: %s (%s)", e.Message, e.Reason)
+	}
+	return "spotify api error: " + e.Message
+}
+
+func (e *SpotifyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SpotifyError) apiError() *apiError {
+	return &apiError{
+		Status:            e.Status,
+		Code:              e.Code,
+		Message:           e.Message,
+		Retryable:         e.Retryable,
+		RetryAfterMS:      e.RetryAfter.Milliseconds(),
+		UpstreamReason:    e.Reason,
+		UpstreamRequestID: e.UpstreamRequestID,
+	}
+}
+
+func asSpotifyError(err error) (*SpotifyError, bool) {
+	var spErr *SpotifyError
+	if errors.As(err, &spErr) {
+		return spErr, true
+	}
+	return nil, false
+}
+
+func hasSpotifyCode(err error, code string) bool {
+	spErr, ok := asSpotifyError(err)
+	return ok && spErr.Code == code
+}
+
+// restrictionReasons are player error reasons meaning the command is not
+// allowed in the current playback context.
+var restrictionReasons = map[string]struct{}{
+	"NO_PREV_TRACK":           {},
+	"NO_NEXT_TRACK":           {},
+	"NO_SPECIFIC_TRACK":       {},
+	"ALREADY_PAUSED":          {},
+	"NOT_PAUSED":              {},
+	"NOT_PLAYING_LOCALLY":     {},
+	"NOT_PLAYING_TRACK":       {},
+	"NOT_PLAYING_CONTEXT":     {},
+	"ENDLESS_CONTEXT":         {},
+	"CONTEXT_DISALLOW":        {},
+	"ALREADY_PLAYING":         {},
+	"REMOTE_CONTROL_DISALLOW": {},
+	"DEVICE_NOT_CONTROLLABLE": {},
+	"VOLUME_CONTROL_DISALLOW": {},
+}
+
+// upstreamRequestIDHeaders are checked in order; Spotify does not document a
+// request-id header, so the first one present is used.
+var upstreamRequestIDHeaders = []string{"X-Request-Id", "X-Correlation-Id", "Sp-Trace-Id"}
+
+// classifySpotifyError maps a failed Spotify response to a SpotifyError.
+func classifySpotifyError(status int, header http.Header, body []byte) *SpotifyError {
+	var payload struct {
+		Error struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+			Reason  string `json:"reason"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &payload)
+	reason := strings.ToUpper(strings.TrimSpace(payload.Error.Reason))
+	message := strings.TrimSpace(payload.Error.Message)
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	lower := strings.ToLower(message)
+
+	e := &SpotifyError{Message: message, UpstreamStatus: status, Reason: reason}
+	for _, name := range upstreamRequestIDHeaders {
+		if v := header.Get(name); v != "" {
+			e.UpstreamRequestID = v
+			break
+		}
+	}
+
+	_, restricted := restrictionReasons[reason]
+	switch {
+	case status == http.StatusTooManyRequests || reason == "RATE_LIMITED":
+		e.Code, e.Status, e.Retryable = codeRateLimited, http.StatusTooManyRequests, true
+		e.RetryAfter = parseRetryAfter(header.Get("Retry-After"))
+		if e.RetryAfter <= 0 {
+			e.RetryAfter = time.Second
+		}
+		e.Message = "Spotify rate limit reached"
+	case reason == "PREMIUM_REQUIRED" || strings.Contains(lower, "premium required"):
+		e.Code, e.Status = codePremiumRequired, http.StatusForbidden
+		e.Message = "Spotify Premium is required for playback control"
+	case reason == "NO_ACTIVE_DEVICE" || strings.Contains(lower, "no active device"):
+		e.Code, e.Status = codeNoActiveDevice, http.StatusNotFound
+		e.Message = "No active Spotify device"
+	case status == http.StatusNotFound && strings.Contains(lower, "device not found"):
+		e.Code, e.Status = codeDeviceNotFound, http.StatusNotFound
+		e.Message = "Spotify device not found"
+	case status == http.StatusUnauthorized:
+		e.Code, e.Status = codeTokenRevoked, http.StatusServiceUnavailable
+	case restricted || (status == http.StatusForbidden && strings.Contains(lower, "restriction violated")):
+		e.Code, e.Status = codeRestrictionViolated, http.StatusConflict
+	case status >= 500:
+		e.Code, e.Status, e.Retryable = codeUpstreamUnavailable, http.StatusBadGateway, true
+		if status == http.StatusServiceUnavailable {
+			e.Status = http.StatusServiceUnavailable
+		}
+		e.RetryAfter = parseRetryAfter(header.Get("Retry-After"))
+	case status == http.StatusBadRequest:
+		e.Code, e.Status = codeInvalidRequest, http.StatusBadRequest
+	case status == http.StatusNotFound:
+		e.Code, e.Status = codeNotFound, http.StatusNotFound
+	default:
+		e.Code, e.Status = codeUpstreamError, http.StatusBadGateway
+	}
+	return e
+}
+
+// transportError wraps a failure to reach Spotify at all.
+func transportError(err error) *SpotifyError {
+	return &SpotifyError{
+		Code:      codeUpstreamUnavailable,
+		Message:   "Spotify is unreachable",
+		Status:    http.StatusBadGateway,
+		Retryable: true,
+		Err:       err,
+	}
+}
+
+// tokenFailure maps a token refresh failure to a SpotifyError.
+func tokenFailure(err error) *SpotifyError {
+	var tokErr *tokenError
+	switch {
+	case errors.As(err, &tokErr) && tokErr.needsReauth():
+		return &SpotifyError{
+			Code:           codeTokenRevoked,
+			Message:        "Spotify authorization was revoked or expired; reconnect Spotify",
+			Status:         http.StatusServiceUnavailable,
+			UpstreamStatus: tokErr.Status,
+			Err:            err,
+		}
+	case errors.As(err, &tokErr) && tokErr.Status == http.StatusTooManyRequests:
+		retryAfter := tokErr.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		return &SpotifyError{
+			Code:           codeRateLimited,
+			Message:        "Spotify token endpoint rate limit reached",
+			Status:         http.StatusTooManyRequests,
+			UpstreamStatus: tokErr.Status,
+			Retryable:      true,
+			RetryAfter:     retryAfter,
+			Err:            err,
+		}
+	case errors.As(err, &tokErr) && tokErr.Status < 500:
+		return &SpotifyError{
+			Code:           codeUpstreamError,
+			Message:        tokErr.Error(),
+			Status:         http.StatusBadGateway,
+			UpstreamStatus: tokErr.Status,
+			Err:            err,
+		}
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The caller gave up while waiting; the shared refresh carries on.
+		return &SpotifyError{
+			Code:      codeTimeout,
+			Message:   "request ended while waiting for a Spotify access token",
+			Status:    http.StatusGatewayTimeout,
+			Retryable: true,
+			Err:       err,
+		}
+	case errors.Is(err, errCredentialsChanged):
+		return &SpotifyError{
+			Code:      codeCredentialsChanged,
+			Message:   "Spotify credentials changed while the request waited for a token",
+			Status:    http.StatusServiceUnavailable,
+			Retryable: true,
+			Err:       err,
+		}
+	}
+	spErr := transportError(err)
+	spErr.Message = "Spotify token endpoint is unavailable"
+	return spErr
+}
+
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
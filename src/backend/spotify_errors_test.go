@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		code       string
+		status     int
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{name: "revoked grant", err: &tokenError{Status: 400, Code: "invalid_grant"}, code: codeTokenRevoked, status: http.StatusServiceUnavailable},
+		{name: "rejected access token", err: &tokenError{Status: 401, Code: "invalid_token"}, code: codeTokenRevoked, status: http.StatusServiceUnavailable},
+		{name: "rate limited", err: &tokenError{Status: 429, RetryAfter: 7 * time.Second}, code: codeRateLimited, status: http.StatusTooManyRequests, retryable: true, retryAfter: 7 * time.Second},
+		{name: "rate limited without Retry-After", err: &tokenError{Status: 429}, code: codeRateLimited, status: http.StatusTooManyRequests, retryable: true, retryAfter: time.Second},
+		{name: "other client error", err: &tokenError{Status: 400, Code: "invalid_request"}, code: codeUpstreamError, status: http.StatusBadGateway},
+		{name: "server error", err: &tokenError{Status: 503}, code: codeUpstreamUnavailable, status: http.StatusBadGateway, retryable: true},
+		{name: "transport error", err: errors.New("connection refused"), code: codeUpstreamUnavailable, status: http.StatusBadGateway, retryable: true},
+		{name: "caller cancelled", err: context.Canceled, code: codeTimeout, status: http.StatusGatewayTimeout, retryable: true},
+		{name: "caller deadline", err: fmt.Errorf("wait: %w", context.DeadlineExceeded), code: codeTimeout, status: http.StatusGatewayTimeout, retryable: true},
+		{name: "credentials changed", err: errCredentialsChanged, code: codeCredentialsChanged, status: http.StatusServiceUnavailable, retryable: true},
+	}
+	for _, tt := range tests {
+		got := tokenFailure(tt.err)
+		if got.Code != tt.code || got.Status != tt.status || got.Retryable != tt.retryable || got.RetryAfter != tt.retryAfter {
+			t.Errorf("%s: got %s %d retryable=%v after %v, want %s %d retryable=%v after %v",
+				tt.name, got.Code, got.Status, got.Retryable, got.RetryAfter, tt.code, tt.status, tt.retryable, tt.retryAfter)
+		}
+		if !errors.Is(got, tt.err) {
+			t.Errorf("%s: the cause is not wrapped", tt.name)
+		}
+	}
+}
+
+func TestTokenEndpoint429(t *testing.T) {
+	stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	spotify := newTestSpotifyClient()
+
+	_, _, err := spotify.Do(context.Background(), http.MethodGet, "/me/player", nil, nil)
+	spErr, ok := asSpotifyError(err)
+	if !ok || spErr.Code != codeRateLimited || spErr.RetryAfter != 2*time.Second {
+		t.Fatalf("err = %v, want rate_limited retrying after 2s", err)
+	}
+	if api := spErr.apiError(); api.Status != http.StatusTooManyRequests || api.RetryAfterMS != 2000 {
+		t.Fatalf("envelope = %+v, want 429 with retry_after_ms 2000", api)
+	}
+}
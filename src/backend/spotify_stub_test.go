@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubSpotify points the Web API and the token endpoint at h for the
+// duration of the test. Web API paths arrive prefixed with /v1, token
+// requests at /api/token.
+func stubSpotify(t *testing.T, h http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	apiBase, tokenURL := spotifyAPIBase, spotifyTokenURL
+	spotifyAPIBase, spotifyTokenURL = srv.URL+"/v1", srv.URL+"/api/token"
+	t.Cleanup(func() {
+		spotifyAPIBase, spotifyTokenURL = apiBase, tokenURL
+		srv.Close()
+	})
+}
+
+// newTestSpotifyClient returns a client with fixed credentials and no token
+// cache or secret store.
+func newTestSpotifyClient() *SpotifyClient {
+	return &SpotifyClient{
+		clientID:      "client",
+		clientSecret:  "secret",
+		refreshToken:  "refresh",
+		sourceRefresh: "refresh",
+		wake:          make(chan struct{}, 1),
+		breakers:      &breakers{threshold: 5, cooldown: time.Minute, families: map[string]*breaker{}},
+		httpClient:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// presetToken publishes an access token, so requests skip the token
+// endpoint.
+func presetToken(c *SpotifyClient, value string) {
+	c.token.Store(&accessToken{value: value, expiresAt: time.Now().Add(time.Hour)})
+}
+
+// eventually polls cond until it holds or a second has passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
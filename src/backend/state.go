@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stateVersion = 1
+
+// StateStore persists in-memory state across restarts: the last playback
+// snapshot, the upstream diagnostics, including any rate-limit cooldown
+// Spotify asked for, and the volumes remembered by mute.
+type StateStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+type savedState struct {
+	Version  int            `json:"version"`
+	SavedAt  time.Time      `json:"saved_at"`
+	Playback *savedPlayback `json:"playback,omitempty"`
+	Upstream UpstreamStatus `json:"upstream"`
+	Mutes    map[string]int `json:"mutes,omitempty"`
+}
+
+type savedPlayback struct {
+	Payload   json.RawMessage `json:"payload"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+func NewStateStore(path string) *StateStore {
+	return &StateStore{path: path}
+}
+
+func NewStateStoreFromEnv() *StateStore {
+	path := Getenv("STATE_PATH", filepath.Join("config", "state.json"))
+	return NewStateStore(filepath.Clean(path))
+}
+
+// Save writes the current state. It is called on shutdown and whenever the
+// mute memory changes.
+func (st *StateStore) Save(playback *PlaybackCache, spotify *SpotifyClient, mutes *MuteMemory) error {
+	if st == nil || strings.TrimSpace(st.path) == "" {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := savedState{
+		Version:  stateVersion,
+		SavedAt:  time.Now(),
+		Upstream: spotify.UpstreamStatus(),
+		Mutes:    mutes.snapshot(),
+	}
+	if payload, updatedAt, ok := playback.snapshot(); ok && json.Valid(payload) {
+		out.Playback = &savedPlayback{Payload: payload, UpdatedAt: updatedAt}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// Load restores state saved by Save. A missing file is not an error; a file
+// written by another version is ignored.
+func (st *StateStore) Load(playback *PlaybackCache, spotify *SpotifyClient, mutes *MuteMemory) error {
+	if st == nil || strings.TrimSpace(st.path) == "" {
+		return nil
+	}
+	data, err := os.ReadFile(st.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var in savedState
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Version != stateVersion {
+		return nil
+	}
+	if in.Playback != nil && len(in.Playback.Payload) > 0 {
+		playback.restore(in.Playback.Payload, in.Playback.UpdatedAt)
+	}
+	spotify.restoreUpstream(in.Upstream)
+	mutes.restore(in.Mutes)
+	return nil
+}
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// requiredWebAssets must be present in WebFS for the tab and widget to load.
+var requiredWebAssets = []string{"ui/index.html", "widgets/player/index.html"}
+
+type readinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type cacheStatus struct {
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	AgeMS     *int64     `json:"age_ms,omitempty"`
+}
+
+type diagnostics struct {
+	Status   string           `json:"status"`
+	Checks   []readinessCheck `json:"checks"`
+	Spotify  AuthStatus       `json:"spotify"`
+	Upstream UpstreamStatus   `json:"upstream"`
+	Breakers []BreakerStatus  `json:"breakers"`
+	Cache    cacheStatus      `json:"cache"`
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":  "ok",
+		"spotify": s.Spotify.AuthStatus().State,
+	})
+}
+
+// handleReadyz reports 503 while the integration cannot serve playback,
+// e.g. before credentials are set or after the refresh token was revoked.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	d := s.diagnostics()
+	status := http.StatusOK
+	if d.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, d)
+}
+
+func (s *Server) handleAuthStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Spotify.AuthStatus())
+}
+
+// handleAdminStatus returns the readiness diagnostics plus which secrets are
+// configured, for the Homenavi integrations page.
+func (s *Server) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if s.AdminAuth == nil || !s.AdminAuth.RequireAdmin(w, r) {
+		return
+	}
+	out := map[string]any{"diagnostics": s.diagnostics()}
+	if s.SecretStore != nil {
+		allowed := map[string]SecretSpec{}
+		for _, spec := range s.SecretSpecs {
+			allowed[spec.Key] = spec
+		}
+		if secrets, err := s.SecretStore.Status(allowed); err == nil {
+			out["secrets"] = secrets
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) diagnostics() diagnostics {
+	auth := s.Spotify.AuthStatus()
+	d := diagnostics{
+		Status:   "ready",
+		Spotify:  auth,
+		Upstream: s.Spotify.UpstreamStatus(),
+		Breakers: s.Spotify.BreakerStatus(),
+	}
+	if updated, ok := s.Playback.UpdatedAt(); ok {
+		age := time.Since(updated).Milliseconds()
+		d.Cache = cacheStatus{UpdatedAt: &updated, AgeMS: &age}
+	}
+
+	credentials := readinessCheck{Name: "credentials", OK: true}
+	switch auth.State {
+	case AuthStateNotConfigured:
+		credentials.OK, credentials.Detail = false, "Spotify credentials are not set"
+	case AuthStateNeedsReauth:
+		credentials.OK, credentials.Detail = false, auth.Reason
+	}
+
+	// A failed refresh only matters once the previous token has expired.
+	token := readinessCheck{Name: "token_refresh", OK: true}
+	if auth.RefreshError != "" && (auth.TokenExpiresAt == nil || time.Now().After(*auth.TokenExpiresAt)) {
+		token.OK, token.Detail = false, auth.RefreshError
+	}
+
+	secrets := readinessCheck{Name: "secrets_file", OK: true}
+	if err := s.SecretStore.Check(); err != nil {
+		secrets.OK, secrets.Detail = false, err.Error()
+	}
+
+	assets := readinessCheck{Name: "web_assets", OK: true}
+	for _, name := range requiredWebAssets {
+		if s.WebFS == nil {
+			assets.OK, assets.Detail = false, "web assets are not available"
+			break
+		}
+		if _, err := fs.Stat(s.WebFS, name); err != nil {
+			assets.OK, assets.Detail = false, name+" is missing"
+			break
+		}
+	}
+
+	d.Checks = []readinessCheck{credentials, token, secrets, assets}
+	for _, check := range d.Checks {
+		if !check.OK {
+			d.Status = "not_ready"
+		}
+	}
+	return d
+}
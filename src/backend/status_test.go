@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDiagnostics(t *testing.T) {
+	webFS := fstest.MapFS{
+		"ui/index.html":             {Data: []byte("<html>")},
+		"widgets/player/index.html": {Data: []byte("<html>")},
+	}
+	brokenSecrets := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(brokenSecrets, []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// setup adjusts a configured client and a server with every check
+		// passing.
+		setup func(s *Server)
+		// failing is the check expected to fail, or "" when ready.
+		failing string
+	}{
+		{name: "ready", setup: func(s *Server) {}},
+		{name: "not configured", setup: func(s *Server) { s.Spotify = nil }, failing: "credentials"},
+		{name: "revoked", setup: func(s *Server) {
+			s.Spotify.reauthErr = &tokenError{Status: 400, Code: "invalid_grant"}
+		}, failing: "credentials"},
+		{name: "refresh failing after expiry", setup: func(s *Server) {
+			s.Spotify.refreshErr = "token endpoint unavailable"
+			s.Spotify.token.Store(&accessToken{value: "old", expiresAt: time.Now().Add(-time.Minute)})
+		}, failing: "token_refresh"},
+		{name: "refresh failing with no token", setup: func(s *Server) {
+			s.Spotify.refreshErr = "token endpoint unavailable"
+		}, failing: "token_refresh"},
+		{name: "refresh failing before expiry", setup: func(s *Server) {
+			s.Spotify.refreshErr = "token endpoint unavailable"
+			s.Spotify.token.Store(&accessToken{value: "current", expiresAt: time.Now().Add(time.Hour)})
+		}},
+		{name: "unreadable secrets file", setup: func(s *Server) {
+			s.SecretStore = &SecretStore{path: brokenSecrets}
+		}, failing: "secrets_file"},
+		{name: "missing secrets file", setup: func(s *Server) {
+			s.SecretStore = &SecretStore{path: filepath.Join(t.TempDir(), "absent.json")}
+		}},
+		{name: "no web assets", setup: func(s *Server) { s.WebFS = nil }, failing: "web_assets"},
+		{name: "missing widget", setup: func(s *Server) {
+			s.WebFS = fstest.MapFS{"ui/index.html": {Data: []byte("<html>")}}
+		}, failing: "web_assets"},
+	}
+	for _, tt := range tests {
+		s := &Server{
+			WebFS:    webFS,
+			Spotify:  &SpotifyClient{wake: make(chan struct{}, 1)},
+			Playback: NewPlaybackCache(),
+		}
+		tt.setup(s)
+		d := s.diagnostics()
+
+		wantStatus := "ready"
+		if tt.failing != "" {
+			wantStatus = "not_ready"
+		}
+		if d.Status != wantStatus {
+			t.Errorf("%s: status = %q, want %q", tt.name, d.Status, wantStatus)
+		}
+		for _, check := range d.Checks {
+			if wantOK := check.Name != tt.failing; check.OK != wantOK {
+				t.Errorf("%s: check %s ok = %v (%s), want %v", tt.name, check.Name, check.OK, check.Detail, wantOK)
+			}
+		}
+	}
+}
+
+func TestUpstreamStatusRateLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		// cooldown is the expected rate-limit cooldown, or 0 for none.
+		cooldown time.Duration
+	}{
+		{name: "success", err: nil},
+		{name: "rate limited", err: &SpotifyError{Code: codeRateLimited, UpstreamStatus: 429, RetryAfter: 30 * time.Second}, cooldown: 30 * time.Second},
+		{name: "rate limited without Retry-After", err: &SpotifyError{Code: codeRateLimited, UpstreamStatus: 429}},
+		{name: "upstream unavailable", err: &SpotifyError{Code: codeUpstreamUnavailable, UpstreamStatus: 503, RetryAfter: 30 * time.Second}},
+	}
+	for _, tt := range tests {
+		c := &SpotifyClient{}
+		c.recordUpstream(tt.err)
+		st := c.UpstreamStatus()
+
+		if tt.err == nil {
+			if st.LastSuccess == nil || st.LastError != nil {
+				t.Errorf("%s: status = %+v, want only a last success", tt.name, st)
+			}
+		} else if st.LastError == nil || st.LastError.Code != tt.err.(*SpotifyError).Code {
+			t.Errorf("%s: last error = %+v, want %s", tt.name, st.LastError, tt.err.(*SpotifyError).Code)
+		}
+		if tt.cooldown == 0 {
+			if st.RateLimitedUntil != nil || st.CooldownMS != 0 {
+				t.Errorf("%s: cooldown = %dms, want none", tt.name, st.CooldownMS)
+			}
+			continue
+		}
+		if st.RateLimitedUntil == nil || st.CooldownMS <= 0 || st.CooldownMS > tt.cooldown.Milliseconds() {
+			t.Errorf("%s: cooldown = %dms, want up to %v", tt.name, st.CooldownMS, tt.cooldown)
+		}
+	}
+}
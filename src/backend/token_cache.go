@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tokenCache persists the current access token (and a rotated refresh token)
+// so a restart does not force a token refresh.
+type tokenCache struct {
+	path string
+}
+
+type cachedToken struct {
+	ClientID string `json:"client_id"`
+	// SourceSHA256 fingerprints the configured refresh token the cached
+	// state was derived from, so stale entries are ignored after the
+	// credentials change.
+	SourceSHA256 string    `json:"source_sha256"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func newTokenCacheFromEnv() *tokenCache {
+	path := Getenv("TOKEN_CACHE_PATH", filepath.Join("config", "spotify.token.json"))
+	return &tokenCache{path: filepath.Clean(path)}
+}
+
+func tokenFingerprint(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func (tc *tokenCache) load() (cachedToken, bool) {
+	if tc == nil || strings.TrimSpace(tc.path) == "" {
+		return cachedToken{}, false
+	}
+	data, err := os.ReadFile(tc.path)
+	if err != nil {
+		return cachedToken{}, false
+	}
+	var out cachedToken
+	if err := json.Unmarshal(data, &out); err != nil {
+		return cachedToken{}, false
+	}
+	return out, true
+}
+
+func (tc *tokenCache) save(tok cachedToken) error {
+	if tc == nil || strings.TrimSpace(tc.path) == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(tc.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tok, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := tc.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tc.path)
+}
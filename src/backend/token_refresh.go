@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tokenExpiryMargin is how close to expiry a token is still handed out.
+	tokenExpiryMargin = 30 * time.Second
+	// tokenRefreshAhead is how long before expiry the background refresher
+	// renews the access token.
+	tokenRefreshAhead = 5 * time.Minute
+	// tokenRefreshTimeout bounds one shared refresh, including retries.
+	tokenRefreshTimeout  = 20 * time.Second
+	tokenRefreshAttempts = 3
+	tokenRetryBase       = 250 * time.Millisecond
+)
+
+var errCredentialsChanged = errors.New("spotify credentials changed during token refresh")
+
+type accessToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (t *accessToken) usable(margin time.Duration) bool {
+	return t != nil && t.value != "" && time.Now().Before(t.expiresAt.Add(-margin))
+}
+
+// refreshCall is one in-flight token refresh, shared by every caller that
+// needs a token while it runs.
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (c *SpotifyClient) ensureToken(ctx context.Context) (string, error) {
+	if tok := c.token.Load(); tok.usable(tokenExpiryMargin) {
+		return tok.value, nil
+	}
+	if err := c.refreshAccessToken(ctx); err != nil {
+		return "", err
+	}
+	tok := c.token.Load()
+	if tok == nil {
+		return "", errCredentialsChanged
+	}
+	return tok.value, nil
+}
+
+// invalidateToken drops the published token if it is still the one that was
+// rejected; a token published by a newer refresh is kept.
+func (c *SpotifyClient) invalidateToken(stale string) {
+	if tok := c.token.Load(); tok != nil && tok.value == stale {
+		c.token.CompareAndSwap(tok, nil)
+	}
+}
+
+// rejectToken moves the client to needs_reauth when Spotify answers 401 to
+// an access token that was refreshed for the retry: refreshing again would
+// not help. A token published since by a newer refresh is kept.
+func (c *SpotifyClient) rejectToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tok := c.token.Load()
+	if c.reauthErr != nil || tok == nil || tok.value != token {
+		return
+	}
+	c.reauthErr = &tokenError{
+		Status:      http.StatusUnauthorized,
+		Code:        "invalid_token",
+		Description: "Spotify rejected a freshly refreshed access token",
+	}
+	c.reauthSince = time.Now()
+	c.token.Store(nil)
+}
+
+// refreshAccessToken joins the in-flight refresh or starts one, then waits
+// for it or for ctx. The refresh itself is not tied to ctx, so a caller
+// giving up does not fail the others waiting on it.
+func (c *SpotifyClient) refreshAccessToken(ctx context.Context) error {
+	c.mu.Lock()
+	if c.reauthErr != nil {
+		err := c.reauthErr
+		c.mu.Unlock()
+		return err
+	}
+	call := c.flight
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		c.flight = call
+		go c.runRefresh(trace.SpanContextFromContext(ctx), call, c.generation, c.clientID, c.clientSecret, c.refreshToken)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runRefresh performs one shared refresh. Its span is parented to the
+// caller that started it.
+func (c *SpotifyClient) runRefresh(parent trace.SpanContext, call *refreshCall, generation uint64, clientID, clientSecret, refreshToken string) {
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpanContext(context.Background(), parent), tokenRefreshTimeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "spotify token refresh", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	parsed, err := c.requestTokenWithRetry(ctx, clientID, clientSecret, refreshToken)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	c.mu.Lock()
+	c.flight = nil
+	if generation != c.generation {
+		c.mu.Unlock()
+		call.err = errCredentialsChanged
+		close(call.done)
+		return
+	}
+	if err != nil {
+		var tokErr *tokenError
+		if errors.As(err, &tokErr) && tokErr.needsReauth() {
+			c.reauthErr = tokErr
+			c.reauthSince = time.Now()
+			c.token.Store(nil)
+		}
+		c.refreshErr = err.Error()
+		c.refreshErrAt = time.Now()
+		c.mu.Unlock()
+		call.err = err
+		close(call.done)
+		return
+	}
+
+	tok := &accessToken{
+		value:     parsed.AccessToken,
+		expiresAt: time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second),
+	}
+	c.token.Store(tok)
+	c.lastRefresh = time.Now()
+	c.refreshErr = ""
+	c.refreshErrAt = time.Time{}
+	rotated := strings.TrimSpace(parsed.RefreshToken)
+	if rotated == c.refreshToken {
+		rotated = ""
+	}
+	if rotated != "" {
+		c.refreshToken = rotated
+	}
+	span.SetAttributes(attribute.Bool("spotify.refresh_token_rotated", rotated != ""))
+	snapshot := cachedToken{
+		ClientID:     c.clientID,
+		SourceSHA256: tokenFingerprint(c.sourceRefresh),
+		RefreshToken: c.refreshToken,
+		AccessToken:  tok.value,
+		ExpiresAt:    tok.expiresAt,
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	// Disk writes happen after the waiters were released.
+	if rotated != "" && c.store != nil {
+		if err := c.store.Set(map[string]string{"SPOTIFY_REFRESH_TOKEN": rotated}); err != nil {
+			slog.Error("persist rotated refresh token", "err", err)
+		}
+	}
+	if err := c.cache.save(snapshot); err != nil {
+		slog.Warn("save token cache", "err", err)
+	}
+}
+
+// requestTokenWithRetry retries transient token endpoint failures with
+// jittered exponential backoff. Rejections of the grant are not retried.
+func (c *SpotifyClient) requestTokenWithRetry(ctx context.Context, clientID, clientSecret, refreshToken string) (tokenResponse, error) {
+	var lastErr error
+	for attempt := 0; attempt < tokenRefreshAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := tokenRetryBase << (attempt - 1)
+			delay := backoff/2 + rand.N(backoff)
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+				attribute.Int("attempt", attempt+1),
+				attribute.String("error", lastErr.Error()),
+			))
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return tokenResponse{}, lastErr
+			case <-timer.C:
+			}
+		}
+		parsed, err := requestToken(ctx, c.httpClient, clientID, clientSecret, refreshToken)
+		if err == nil {
+			return parsed, nil
+		}
+		lastErr = err
+		if !transientTokenError(err) {
+			break
+		}
+	}
+	return tokenResponse{}, lastErr
+}
+
+func transientTokenError(err error) bool {
+	var tokErr *tokenError
+	if errors.As(err, &tokErr) {
+		return tokErr.Status >= 500 || tokErr.Status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Run refreshes the access token in the background shortly before it
+// expires, so requests rarely wait on the token endpoint. It returns when ctx
+// is done.
+func (c *SpotifyClient) Run(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	backoff := 30 * time.Second
+	for {
+		var wait time.Duration
+		if tok := c.token.Load(); tok != nil {
+			wait = time.Until(tok.expiresAt.Add(-tokenRefreshAhead))
+		}
+		c.mu.Lock()
+		blocked := c.reauthErr != nil
+		c.mu.Unlock()
+
+		if blocked {
+			// Nothing to do until the credentials change.
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.wake:
+			}
+			continue
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-c.wake:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+		}
+
+		if err := c.refreshAccessToken(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("spotify token refresh failed", "err", err, "retry_in", backoff.String())
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-c.wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+			backoff = min(backoff*2, 5*time.Minute)
+			continue
+		}
+		backoff = 30 * time.Second
+	}
+}
+
+func (c *SpotifyClient) signalWake() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
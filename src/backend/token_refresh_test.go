@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenStub issues "fresh" from its token endpoint, counting the requests,
+// and answers Web API calls with 401 unless they carry that token.
+type tokenStub struct {
+	tokenRequests atomic.Int32
+	apiCalls      atomic.Int32
+	// delay holds each token response, so concurrent callers pile up on
+	// the refresh in flight.
+	delay time.Duration
+}
+
+func (s *tokenStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/token" {
+		s.tokenRequests.Add(1)
+		time.Sleep(s.delay)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"fresh","token_type":"Bearer","expires_in":3600,"scope":"user-read-playback-state"}`)
+		return
+	}
+	s.apiCalls.Add(1)
+	if r.Header.Get("Authorization") != "Bearer fresh" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"status":401,"message":"The access token expired"}}`)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func concurrentDo(t *testing.T, spotify *SpotifyClient, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := spotify.Do(context.Background(), http.MethodGet, "/me/player", nil, nil); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Do: %v", err)
+	}
+}
+
+func TestConcurrent401sShareOneRefresh(t *testing.T) {
+	stub := &tokenStub{delay: 50 * time.Millisecond}
+	stubSpotify(t, stub)
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "stale")
+
+	const callers = 20
+	concurrentDo(t, spotify, callers)
+
+	if n := stub.tokenRequests.Load(); n != 1 {
+		t.Fatalf("token requests = %d, want 1 for %d callers", n, callers)
+	}
+	// Every caller got its 401 and retried once with the new token.
+	if n := stub.apiCalls.Load(); n != 2*callers {
+		t.Errorf("api calls = %d, want %d", n, 2*callers)
+	}
+	if tok := spotify.token.Load(); tok == nil || tok.value != "fresh" {
+		t.Errorf("published token = %v, want fresh", tok)
+	}
+}
+
+func TestColdStartSharesOneRefresh(t *testing.T) {
+	stub := &tokenStub{delay: 50 * time.Millisecond}
+	stubSpotify(t, stub)
+	spotify := newTestSpotifyClient()
+
+	concurrentDo(t, spotify, 20)
+
+	if n := stub.tokenRequests.Load(); n != 1 {
+		t.Fatalf("token requests = %d, want 1", n)
+	}
+}
+
+func TestNewerTokenSurvivesStale401(t *testing.T) {
+	stubSpotify(t, &tokenStub{})
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "newer")
+
+	// A 401 for an older token must not drop the one published since.
+	spotify.invalidateToken("stale")
+	if tok := spotify.token.Load(); tok == nil || tok.value != "newer" {
+		t.Fatalf("published token = %v, want newer", tok)
+	}
+}
+
+func TestPersistent401NeedsReauth(t *testing.T) {
+	stub := &tokenStub{}
+	stubSpotify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/token" {
+			stub.ServeHTTP(w, r)
+			return
+		}
+		// Even the refreshed token is rejected.
+		stub.apiCalls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"status":401,"message":"Invalid access token"}}`)
+	}))
+	spotify := newTestSpotifyClient()
+	presetToken(spotify, "stale")
+
+	_, _, err := spotify.Do(context.Background(), http.MethodGet, "/me/player", nil, nil)
+	if !hasSpotifyCode(err, codeTokenRevoked) {
+		t.Fatalf("err = %v, want %s", err, codeTokenRevoked)
+	}
+	if st := spotify.AuthStatus(); st.State != AuthStateNeedsReauth {
+		t.Fatalf("auth state = %q, want %q", st.State, AuthStateNeedsReauth)
+	}
+
+	// Until the credentials change, nothing more is sent to Spotify.
+	_, _, err = spotify.Do(context.Background(), http.MethodGet, "/me/player", nil, nil)
+	if !hasSpotifyCode(err, codeTokenRevoked) {
+		t.Fatalf("second err = %v, want %s", err, codeTokenRevoked)
+	}
+	if n := stub.tokenRequests.Load(); n != 1 {
+		t.Errorf("token requests = %d, want 1", n)
+	}
+	if n := stub.apiCalls.Load(); n != 2 {
+		t.Errorf("api calls = %d, want 2", n)
+	}
+
+	// Reloading the same credentials clears it, as the grant itself was
+	// never refused.
+	t.Setenv("SPOTIFY_CLIENT_ID", "client")
+	t.Setenv("SPOTIFY_CLIENT_SECRET", "secret")
+	t.Setenv("SPOTIFY_REFRESH_TOKEN", "refresh")
+	if err := spotify.ReloadCredentials(); err != nil {
+		t.Fatalf("ReloadCredentials: %v", err)
+	}
+	if st := spotify.AuthStatus(); st.State != AuthStateOK {
+		t.Fatalf("auth state after reload = %q, want %q", st.State, AuthStateOK)
+	}
+	// The next call refreshes again; the stub still rejects every token.
+	_, _, _ = spotify.Do(context.Background(), http.MethodGet, "/me/player", nil, nil)
+	if n := stub.tokenRequests.Load(); n != 3 {
+		t.Errorf("token requests after reload = %d, want 3", n)
+	}
+}
+
+func TestReloadKeepsRevokedGrant(t *testing.T) {
+	t.Setenv("SPOTIFY_CLIENT_ID", "client")
+	t.Setenv("SPOTIFY_CLIENT_SECRET", "secret")
+	t.Setenv("SPOTIFY_REFRESH_TOKEN", "refresh")
+	spotify := newTestSpotifyClient()
+	spotify.reauthErr = &tokenError{Status: http.StatusBadRequest, Code: "invalid_grant"}
+
+	if err := spotify.ReloadCredentials(); err != nil {
+		t.Fatalf("ReloadCredentials: %v", err)
+	}
+	if st := spotify.AuthStatus(); st.State != AuthStateNeedsReauth {
+		t.Fatalf("auth state = %q, want %q until the refresh token changes", st.State, AuthStateNeedsReauth)
+	}
+}
@@ -0,0 +1,29 @@
+package backend
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until tracing.Setup installs an exporter.
+var tracer = otel.Tracer("github.com/homenavi/spotify-integration/src/backend")
+
+// annotateSpan adds attributes to the current request's span, if any.
+func annotateSpan(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+func cacheHitAttr(hit bool) attribute.KeyValue {
+	return attribute.Bool("playback.cache_hit", hit)
+}
+
+func deviceIDAttr(id string) attribute.KeyValue {
+	return attribute.String("spotify.device_id", id)
+}
+
+func confirmStatusAttr(status string) attribute.KeyValue {
+	return attribute.String("command.confirm_status", status)
+}
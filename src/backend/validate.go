@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxBodyBytes = 16 << 10
+
+// apiError is the error envelope returned by every route:
+//
+//	{"error": "volume_percent must be between 0 and 100", "code": "invalid_field", "status": 400, "field": "volume_percent"}
+type apiError struct {
+	Status            int    `json:"status"`
+	Code              string `json:"code"`
+	Message           string `json:"error"`
+	Field             string `json:"field,omitempty"`
+	Retryable         bool   `json:"retryable,omitempty"`
+	RetryAfterMS      int64  `json:"retry_after_ms,omitempty"`
+	UpstreamReason    string `json:"upstream_reason,omitempty"`
+	UpstreamRequestID string `json:"upstream_request_id,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func invalidField(field, format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: "invalid_field", Message: fmt.Sprintf(format, args...), Field: field}
+}
+
+func writeAPIError(w http.ResponseWriter, err *apiError) {
+	if err.RetryAfterMS > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt((err.RetryAfterMS+999)/1000, 10))
+	}
+	writeJSON(w, err.Status, err)
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusRequestEntityTooLarge:
+		return "payload_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return "upstream_unavailable"
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "error"
+}
+
+// decodeJSON decodes a size-limited JSON object into dst, rejecting unknown
+// fields and trailing data. An empty body is accepted when allowEmpty is set
+// and leaves dst untouched.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any, allowEmpty bool) *apiError {
+	if r.Body == nil || r.Body == http.NoBody {
+		if allowEmpty {
+			return nil
+		}
+		return &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "request body is required"}
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err, allowEmpty)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "request body must contain a single JSON object"}
+	}
+	return nil
+}
+
+func decodeError(err error, allowEmpty bool) *apiError {
+	var (
+		maxErr    *http.MaxBytesError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, io.EOF):
+		if allowEmpty {
+			return nil
+		}
+		return &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "request body is required"}
+	case errors.As(err, &maxErr):
+		return &apiError{Status: http.StatusRequestEntityTooLarge, Code: "payload_too_large", Message: fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit)}
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "invalid json"}
+	case errors.As(err, &typeErr):
+		return invalidField(typeErr.Field, "%s must be of type %s", typeErr.Field, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &apiError{Status: http.StatusBadRequest, Code: "unknown_field", Message: "unknown field " + field, Field: field}
+	}
+	return &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "invalid json"}
+}
+
+var (
+	spotifyIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+	deviceIDPattern  = regexp.MustCompile(`^[0-9A-Za-z_-]{1,128}$`)
+)
+
+var (
+	playableTypes = []string{"track", "episode"}
+	contextTypes  = []string{"album", "artist", "playlist", "show", "audiobook"}
+)
+
+// normalizeSpotifyURI accepts "spotify:<type>:<id>" URIs and
+// open.spotify.com links and returns the canonical URI, provided its type is
+// one of allowed.
+func normalizeSpotifyURI(field, raw string, allowed []string) (string, *apiError) {
+	raw = strings.TrimSpace(raw)
+	var kind, id string
+	if strings.HasPrefix(raw, "spotify:") {
+		parts := strings.Split(raw, ":")
+		if len(parts) != 3 {
+			return "", invalidField(field, "%s is not a valid Spotify URI", field)
+		}
+		kind, id = parts[1], parts[2]
+	} else {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "https" || !strings.EqualFold(u.Host, "open.spotify.com") {
+			return "", invalidField(field, "%s must be a spotify: URI or an open.spotify.com link", field)
+		}
+		segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+		// Localized links look like /intl-de/track/<id>.
+		if len(segments) == 3 && strings.HasPrefix(segments[0], "intl-") {
+			segments = segments[1:]
+		}
+		if len(segments) != 2 {
+			return "", invalidField(field, "%s is not a valid Spotify link", field)
+		}
+		kind, id = segments[0], segments[1]
+	}
+	if !spotifyIDPattern.MatchString(id) {
+		return "", invalidField(field, "%s has an invalid Spotify id", field)
+	}
+	for _, t := range allowed {
+		if kind == t {
+			return "spotify:" + kind + ":" + id, nil
+		}
+	}
+	return "", invalidField(field, "%s must be a Spotify URI of type %s", field, strings.Join(allowed, ", "))
+}
+
+func validateDeviceID(field, id string) *apiError {
+	if id != "" && !deviceIDPattern.MatchString(id) {
+		return invalidField(field, "%s is not a valid device id", field)
+	}
+	return nil
+}
+
+func validateVolume(v int) *apiError {
+	if v < 0 || v > 100 {
+		return invalidField("volume_percent", "volume_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func validatePosition(field string, v int) *apiError {
+	if v < 0 {
+		return invalidField(field, "%s must be zero or greater", field)
+	}
+	return nil
+}
+
+func validateRepeat(state string) *apiError {
+	switch state {
+	case "off", "track", "context":
+		return nil
+	}
+	return invalidField("state", "state must be one of off, track, context")
+}
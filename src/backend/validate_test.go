@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSpotifyURI(t *testing.T) {
+	const id = "4uLU6hMCjMI75M1A2tKUQC"
+	tests := []struct {
+		raw     string
+		allowed []string
+		want    string
+		wantErr bool
+	}{
+		{raw: "spotify:track:" + id, allowed: playableTypes, want: "spotify:track:" + id},
+		{raw: "  spotify:episode:" + id + " ", allowed: playableTypes, want: "spotify:episode:" + id},
+		{raw: "https://open.spotify.com/track/" + id, allowed: playableTypes, want: "spotify:track:" + id},
+		{raw: "https://open.spotify.com/track/" + id + "?si=abc", allowed: playableTypes, want: "spotify:track:" + id},
+		{raw: "https://OPEN.spotify.com/album/" + id + "/", allowed: []string{"album"}, want: "spotify:album:" + id},
+		{raw: "https://open.spotify.com/intl-de/playlist/" + id, allowed: []string{"playlist"}, want: "spotify:playlist:" + id},
+		{raw: "", allowed: playableTypes, wantErr: true},
+		{raw: "spotify:track", allowed: playableTypes, wantErr: true},
+		{raw: "spotify:user:alice:playlist:" + id, allowed: []string{"playlist"}, wantErr: true},
+		{raw: "spotify:track:short", allowed: playableTypes, wantErr: true},
+		{raw: "spotify:track:" + id + "x", allowed: playableTypes, wantErr: true},
+		{raw: "spotify:track:4uLU6hMCjMI75M1A2tKU-C", allowed: playableTypes, wantErr: true},
+		{raw: "spotify:album:" + id, allowed: playableTypes, wantErr: true},
+		{raw: "http://open.spotify.com/track/" + id, allowed: playableTypes, wantErr: true},
+		{raw: "https://evil.example/track/" + id, allowed: playableTypes, wantErr: true},
+		{raw: "https://open.spotify.com/track", allowed: playableTypes, wantErr: true},
+		{raw: "https://open.spotify.com/embed/track/" + id, allowed: playableTypes, wantErr: true},
+		{raw: "track:" + id, allowed: playableTypes, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, apiErr := normalizeSpotifyURI("uri", tt.raw, tt.allowed)
+		if tt.wantErr {
+			if apiErr == nil {
+				t.Errorf("%q: got %q, want an error", tt.raw, got)
+			} else if apiErr.Status != http.StatusBadRequest || apiErr.Code != "invalid_field" || apiErr.Field != "uri" {
+				t.Errorf("%q: error = %+v, want a 400 invalid_field for uri", tt.raw, apiErr)
+			}
+			continue
+		}
+		if apiErr != nil {
+			t.Errorf("%q: %v", tt.raw, apiErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type body struct {
+		Volume int `json:"volume_percent"`
+	}
+	tests := []struct {
+		name       string
+		body       string
+		allowEmpty bool
+		status     int
+		code       string
+	}{
+		{name: "valid", body: `{"volume_percent":40}`},
+		{name: "empty allowed", body: "", allowEmpty: true},
+		{name: "empty required", body: "", status: http.StatusBadRequest, code: "invalid_json"},
+		{name: "syntax error", body: `{"volume_percent":`, status: http.StatusBadRequest, code: "invalid_json"},
+		{name: "wrong type", body: `{"volume_percent":"loud"}`, status: http.StatusBadRequest, code: "invalid_field"},
+		{name: "unknown field", body: `{"volume":40}`, status: http.StatusBadRequest, code: "unknown_field"},
+		{name: "trailing data", body: `{"volume_percent":40}{}`, status: http.StatusBadRequest, code: "invalid_json"},
+		{name: "too large", body: `{"volume_percent":40,"x":"` + strings.Repeat("a", maxBodyBytes) + `"}`, status: http.StatusRequestEntityTooLarge, code: "payload_too_large"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/api/volume", strings.NewReader(tt.body))
+		var dst body
+		apiErr := decodeJSON(httptest.NewRecorder(), r, &dst, tt.allowEmpty)
+		if tt.status == 0 {
+			if apiErr != nil {
+				t.Errorf("%s: %v", tt.name, apiErr)
+			}
+			continue
+		}
+		if apiErr == nil || apiErr.Status != tt.status || apiErr.Code != tt.code {
+			t.Errorf("%s: error = %+v, want %d %s", tt.name, apiErr, tt.status, tt.code)
+		}
+	}
+}
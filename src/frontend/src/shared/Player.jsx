@@ -1,6 +1,7 @@
 import React from 'react';
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
 import {
+  faArrowLeft,
   faBackwardStep,
   faForwardStep,
   faPause,
@@ -29,7 +30,10 @@ import {
   seek,
   addToQueue,
   transferPlayback,
-  searchTracks,
+  search,
+  getAlbum,
+  getArtist,
+  imageUrl,
 } from './api';
 
 function formatMs(ms = 0) {
@@ -41,16 +45,39 @@ function formatMs(ms = 0) {
 
 const repeatCycle = ['off', 'context', 'track'];
 
+const searchFilters = [
+  { id: 'all', label: 'All' },
+  { id: 'track', label: 'Songs' },
+  { id: 'album', label: 'Albums' },
+  { id: 'artist', label: 'Artists' },
+  { id: 'playlist', label: 'Playlists' },
+];
+
+const searchTypeLabels = {
+  track: 'Song',
+  album: 'Album',
+  artist: 'Artist',
+  playlist: 'Playlist',
+  show: 'Podcast',
+  episode: 'Episode',
+  audiobook: 'Audiobook',
+};
+
 export default function Player({ variant = 'tab', showSearch = false, showQueue = true }) {
   const [state, setState] = React.useState(null);
   const [queue, setQueue] = React.useState(null);
   const [devices, setDevices] = React.useState([]);
   const [error, setError] = React.useState('');
+  const [needsReauth, setNeedsReauth] = React.useState(false);
   const [loading, setLoading] = React.useState(true);
   const [scrub, setScrub] = React.useState(null);
   const [volume, setVolumeState] = React.useState(null);
   const [searchQuery, setSearchQuery] = React.useState('');
+  const [searchFilter, setSearchFilter] = React.useState('all');
   const [searchResults, setSearchResults] = React.useState([]);
+  const [searchNextOffset, setSearchNextOffset] = React.useState(null);
+  // detail is the album or artist opened from a search result.
+  const [detail, setDetail] = React.useState(null);
   const [searching, setSearching] = React.useState(false);
   const [canShowQueue, setCanShowQueue] = React.useState(showQueue);
   const [bgCover, setBgCover] = React.useState('');
@@ -73,7 +100,7 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
   }, []);
 
   const activeItem = state?.item || state?.currently_playing || null;
-  const cover = activeItem?.album?.images?.[0]?.url || activeItem?.images?.[0]?.url || '';
+  const cover = imageUrl(activeItem?.album?.images?.[0]?.url || activeItem?.images?.[0]?.url || '');
   const artist = activeItem?.artists?.map((a) => a.name).join(', ') || 'No artist';
   const title = activeItem?.name || 'Nothing playing';
   const durationMs = activeItem?.duration_ms || 0;
@@ -136,6 +163,7 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
       if (showQueue) setQueue(nextQueue);
       setDevices(nextDevices?.devices || []);
       setError('');
+      setNeedsReauth(false);
       if (scrub === null) {
         const nextVolume = frozen && optimistic?.volume_percent != null
           ? optimistic.volume_percent
@@ -146,6 +174,7 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
       }
     } catch (err) {
       setError(err?.message || 'Unable to load Spotify');
+      setNeedsReauth(err?.code === 'token_revoked');
     } finally {
       setLoading(false);
     }
@@ -280,16 +309,34 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
     }
   };
 
-  const handleSearch = async (value) => {
+  const clearSearch = () => {
+    setSearchQuery('');
+    setSearchResults([]);
+    setSearchNextOffset(null);
+    setDetail(null);
+  };
+
+  // handleSearch shows the merged top results for "All" and one paginated
+  // type otherwise; offset > 0 appends the next page.
+  const handleSearch = async (value, offset = 0) => {
     const query = value ?? searchQuery;
     if (!query.trim()) {
       setSearchResults([]);
+      setSearchNextOffset(null);
       return;
     }
     setSearching(true);
     try {
-      const res = await searchTracks(query.trim());
-      setSearchResults(res?.tracks?.items || []);
+      if (searchFilter === 'all') {
+        const res = await search(query.trim());
+        setSearchResults(res?.top || []);
+        setSearchNextOffset(null);
+      } else {
+        const res = await search(query.trim(), { types: [searchFilter], offset });
+        const page = res?.results?.[searchFilter];
+        setSearchResults((prev) => (offset > 0 ? [...prev, ...(page?.items || [])] : page?.items || []));
+        setSearchNextOffset(page?.next_offset ?? null);
+      }
     } catch (err) {
       setError(err?.message || 'Search failed');
     } finally {
@@ -306,9 +353,195 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
     return () => {
       if (debounceRef.current) clearTimeout(debounceRef.current);
     };
-  }, [searchQuery, showSearch]);
+  }, [searchQuery, searchFilter, showSearch]);
 
   const deviceId = state?.device?.id;
+
+  const openDetail = async (kind, id) => {
+    if (!id) return;
+    setDetail({ kind, id, data: null, loading: true });
+    try {
+      const data = kind === 'album' ? await getAlbum(id) : await getArtist(id);
+      setDetail((prev) => (prev?.id === id ? { kind, id, data, loading: false } : prev));
+    } catch (err) {
+      setError(err?.message || 'Failed to load');
+      setDetail((prev) => (prev?.id === id ? null : prev));
+    }
+  };
+
+  // loadMoreDetail appends the next page of album tracks or artist albums.
+  const loadMoreDetail = async () => {
+    if (!detail?.data) return;
+    const { kind, id, data } = detail;
+    const key = kind === 'album' ? 'tracks' : 'albums';
+    const offset = data[key]?.next_offset;
+    if (offset == null) return;
+    setDetail((prev) => ({ ...prev, loading: true }));
+    try {
+      const next = kind === 'album' ? await getAlbum(id, { offset }) : await getArtist(id, { offset });
+      setDetail((prev) => {
+        if (prev?.id !== id) return prev;
+        const items = [...prev.data[key].items, ...(next?.[key]?.items || [])];
+        return { ...prev, loading: false, data: { ...prev.data, [key]: { ...next[key], items } } };
+      });
+    } catch (err) {
+      setError(err?.message || 'Failed to load');
+      setDetail((prev) => (prev?.id === id ? { ...prev, loading: false } : prev));
+    }
+  };
+
+  const playItem = async (item) => {
+    setOptimistic({ is_playing: true });
+    setState((prev) => (prev ? { ...prev, is_playing: true } : prev));
+    try {
+      await play(item.play);
+      clearSearch();
+    } catch (err) {
+      setError(err?.message || 'Failed to play');
+    }
+    refresh();
+  };
+
+  const queueItem = async (item) => {
+    try {
+      await addToQueue(item.uri, deviceId);
+      clearSearch();
+    } catch (err) {
+      setError(err?.message || 'Failed to add to queue');
+    }
+    refresh();
+  };
+
+  // drillTarget is where a result leads: albums and artists open
+  // themselves, tracks open their album.
+  const drillTarget = (item) => {
+    if (item.type === 'album' || item.type === 'artist') return [item.type, item.id];
+    if (item.type === 'track' && item.album?.id) return ['album', item.album.id];
+    return null;
+  };
+
+  const renderResult = (item) => {
+    const target = drillTarget(item);
+    const meta = (
+      <>
+        <div className="spotify-search-title">{item.name}</div>
+        <div className="spotify-search-artist">
+          {[searchTypeLabels[item.type], item.subtitle].filter(Boolean).join(' · ')}
+        </div>
+      </>
+    );
+    return (
+      <div className="spotify-search-item" key={item.uri}>
+        {item.image_url ? (
+          <img
+            className={['spotify-search-cover', item.type === 'artist' ? 'round' : ''].join(' ')}
+            src={imageUrl(item.image_url)}
+            alt=""
+            aria-hidden="true"
+          />
+        ) : (
+          <div className="spotify-search-cover spotify-search-cover-empty" aria-hidden="true" />
+        )}
+        {target ? (
+          <button
+            type="button"
+            className="spotify-search-meta spotify-search-link"
+            onClick={() => openDetail(target[0], target[1])}
+            title={target[0] === 'album' ? 'Open album' : 'Open artist'}
+          >
+            {meta}
+          </button>
+        ) : (
+          <div className="spotify-search-meta">{meta}</div>
+        )}
+        <div className="spotify-search-actions">
+          <button className="spotify-btn" disabled={item.playable === false} onClick={() => playItem(item)}>
+            <FontAwesomeIcon icon={faPlay} />
+            <span className="spotify-btn-label">Play now</span>
+          </button>
+          {item.queueable ? (
+            <button className="spotify-btn" disabled={item.playable === false} onClick={() => queueItem(item)}>
+              <FontAwesomeIcon icon={faPlus} />
+              <span className="spotify-btn-label">Add to queue</span>
+            </button>
+          ) : null}
+        </div>
+      </div>
+    );
+  };
+
+  const renderDetail = () => {
+    const { kind, data, loading: detailLoading } = detail;
+    const page = data ? (kind === 'album' ? data.tracks : data.albums) : null;
+    const facts =
+      kind === 'album'
+        ? [data?.release_date?.slice(0, 4), data?.total_tracks ? `${data.total_tracks} tracks` : '']
+        : [data?.genres?.slice(0, 2).join(', '), data?.followers ? `${data.followers.toLocaleString()} followers` : ''];
+    return (
+      <div className="spotify-search-results">
+        <div className="spotify-detail-header">
+          <button className="spotify-btn spotify-icon-btn" type="button" onClick={() => setDetail(null)} title="Back to results">
+            <FontAwesomeIcon icon={faArrowLeft} />
+          </button>
+          {data?.image_url ? (
+            <img
+              className={['spotify-search-cover', kind === 'artist' ? 'round' : ''].join(' ')}
+              src={imageUrl(data.image_url)}
+              alt=""
+              aria-hidden="true"
+            />
+          ) : (
+            <div className="spotify-search-cover spotify-search-cover-empty" aria-hidden="true" />
+          )}
+          <div className="spotify-search-meta">
+            <div className="spotify-search-title">{data?.name || 'Loading…'}</div>
+            <div className="spotify-search-artist">
+              {kind === 'album'
+                ? data?.artists?.map((artist) => (
+                    <button
+                      key={artist.id || artist.name}
+                      type="button"
+                      className="spotify-search-link spotify-inline-link"
+                      disabled={!artist.id}
+                      onClick={() => openDetail('artist', artist.id)}
+                    >
+                      {artist.name}
+                    </button>
+                  ))
+                : null}
+              {facts.filter(Boolean).join(' · ')}
+            </div>
+          </div>
+          {data ? (
+            <button className="spotify-btn" onClick={() => playItem(data)}>
+              <FontAwesomeIcon icon={faPlay} />
+              <span className="spotify-btn-label">Play</span>
+            </button>
+          ) : null}
+        </div>
+
+        {kind === 'artist' && data?.top_tracks?.length ? (
+          <>
+            <div className="spotify-section-label">Popular</div>
+            {data.top_tracks.map(renderResult)}
+          </>
+        ) : null}
+        {kind === 'artist' && page?.items?.length ? <div className="spotify-section-label">Albums and singles</div> : null}
+        {page?.items?.map(renderResult)}
+        {page?.next_offset != null ? (
+          <button className="spotify-btn" type="button" disabled={detailLoading} onClick={loadMoreDetail}>
+            {detailLoading ? 'Loading…' : 'Load more'}
+          </button>
+        ) : null}
+        {kind === 'artist' && data?.related_artists?.length ? (
+          <>
+            <div className="spotify-section-label">Related artists</div>
+            {data.related_artists.slice(0, 6).map(renderResult)}
+          </>
+        ) : null}
+      </div>
+    );
+  };
   const showQueueBlock = showQueue && (variant !== 'widget' || canShowQueue);
   const handleOpenTab = () => {
     if (variant !== 'widget') return;
@@ -343,6 +576,26 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
     );
   }
 
+  if (needsReauth) {
+    return (
+      <div className={['spotify-shell', variant === 'widget' ? 'spotify-compact' : '', 'cover-dark'].join(' ')}>
+        <div className="spotify-card">
+          <div className="spotify-card-content">
+            <div className="spotify-header">
+              <div className="spotify-widget-header">
+                <FontAwesomeIcon icon={faSpotify} className="spotify-widget-icon" />
+                <span className="spotify-widget-title">Spotify</span>
+              </div>
+              <span className="spotify-pill">Reconnect</span>
+            </div>
+            <div className="spotify-subtitle">Reconnect Spotify.</div>
+            <div className="spotify-subtitle">The Spotify authorization was revoked or expired. Update SPOTIFY_REFRESH_TOKEN in Admin → Integrations.</div>
+          </div>
+        </div>
+      </div>
+    );
+  }
+
   return (
     <div
       ref={containerRef}
@@ -369,14 +622,16 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
                     className="spotify-input"
                     placeholder="Search for a song, artist, or album"
                     value={searchQuery}
-                    onChange={(e) => setSearchQuery(e.target.value)}
+                    onChange={(e) => {
+                      setSearchQuery(e.target.value);
+                      setDetail(null);
+                    }}
                   />
                   {searchQuery ? (
                     <button
                       className="spotify-btn spotify-icon-btn"
                       onClick={() => {
-                        setSearchQuery('');
-                        setSearchResults([]);
+                        clearSearch();
                         setSearching(false);
                       }}
                       title="Clear"
@@ -391,49 +646,39 @@ export default function Player({ variant = 'tab', showSearch = false, showQueue
                 </button>
               </div>
 
-              {searchResults.length ? (
+              <div className="spotify-search-filters" role="tablist">
+                {searchFilters.map((filter) => (
+                  <button
+                    key={filter.id}
+                    type="button"
+                    role="tab"
+                    aria-selected={searchFilter === filter.id}
+                    className={['spotify-chip', searchFilter === filter.id ? 'active' : ''].join(' ')}
+                    onClick={() => {
+                      setSearchFilter(filter.id);
+                      setDetail(null);
+                    }}
+                  >
+                    {filter.label}
+                  </button>
+                ))}
+              </div>
+
+              {detail ? (
+                renderDetail()
+              ) : searchResults.length ? (
                 <div className="spotify-search-results">
-                  {searchResults.slice(0, 8).map((track) => (
-                    <div className="spotify-search-item" key={track.id}>
-                      {track.album?.images?.[2]?.url ? (
-                        <img className="spotify-search-cover" src={track.album.images[2].url} alt="" aria-hidden="true" />
-                      ) : (
-                        <div className="spotify-search-cover spotify-search-cover-empty" aria-hidden="true" />
-                      )}
-                      <div className="spotify-search-meta">
-                        <div className="spotify-search-title">{track.name}</div>
-                        <div className="spotify-search-artist">{track.artists?.map((a) => a.name).join(', ')}</div>
-                      </div>
-                      <div className="spotify-search-actions">
-                        <button
-                          className="spotify-btn"
-                          onClick={async () => {
-                            setOptimistic({ is_playing: true });
-                            setState((prev) => (prev ? { ...prev, is_playing: true } : prev));
-                            await play({ uris: [track.uri] });
-                            setSearchQuery('');
-                            setSearchResults([]);
-                            refresh();
-                          }}
-                        >
-                          <FontAwesomeIcon icon={faPlay} />
-                          <span className="spotify-btn-label">Play now</span>
-                        </button>
-                        <button
-                          className="spotify-btn"
-                          onClick={async () => {
-                            await addToQueue(track.uri, deviceId);
-                            setSearchQuery('');
-                            setSearchResults([]);
-                            refresh();
-                          }}
-                        >
-                          <FontAwesomeIcon icon={faPlus} />
-                          <span className="spotify-btn-label">Add to queue</span>
-                        </button>
-                      </div>
-                    </div>
-                  ))}
+                  {searchResults.map(renderResult)}
+                  {searchNextOffset != null ? (
+                    <button
+                      className="spotify-btn"
+                      type="button"
+                      disabled={searching}
+                      onClick={() => handleSearch(undefined, searchNextOffset)}
+                    >
+                      {searching ? 'Loading…' : 'Load more'}
+                    </button>
+                  ) : null}
                 </div>
               ) : (
                 <div className="spotify-empty">{loading ? 'Loading…' : 'Search results appear here.'}</div>
@@ -15,13 +15,35 @@ function buildUrl(path) {
   return `${base}${path}`;
 }
 
+// apiError unwraps the backend's error envelope
+// ({"error": "...", "code": "...", "status": 400, "field": "..."}).
+function apiError(status, text) {
+  let envelope = null;
+  try {
+    envelope = text ? JSON.parse(text) : null;
+  } catch {
+    envelope = null;
+  }
+  const message = (envelope && typeof envelope.error === 'string' && envelope.error) || text || 'Request failed';
+  const err = new Error(message);
+  err.status = envelope?.status || status;
+  err.code = envelope?.code || '';
+  err.field = envelope?.field || '';
+  return err;
+}
+
 async function jsonRequest(path, options = {}) {
-  const resp = await fetch(buildUrl(path), options);
+  const method = (options.method || 'GET').toUpperCase();
+  const headers = { ...(options.headers || {}) };
+  if (method !== 'GET' && method !== 'HEAD') {
+    // Required by the backend's CSRF check for cookie-authenticated requests.
+    headers['X-Requested-With'] = 'homenavi-spotify';
+  }
+  const resp = await fetch(buildUrl(path), { ...options, headers, credentials: 'same-origin' });
   if (resp.status === 204) return null;
   const text = await resp.text();
   if (!resp.ok) {
-    const message = text || 'Request failed';
-    throw new Error(message);
+    throw apiError(resp.status, text);
   }
   if (!text) return null;
   const contentType = resp.headers.get('content-type') || '';
@@ -35,6 +57,14 @@ async function jsonRequest(path, options = {}) {
   }
 }
 
+// imageUrl routes Spotify CDN artwork through the same-origin /api/image proxy
+// so the Content-Security-Policy does not need to allow remote image hosts.
+export function imageUrl(src) {
+  if (!src || !/^https:\/\//.test(src)) return src || '';
+  const params = new URLSearchParams({ url: src });
+  return buildUrl(`/api/image?${params.toString()}`);
+}
+
 export function getState() {
   return jsonRequest('/api/state');
 }
@@ -115,7 +145,32 @@ export function transferPlayback(deviceId, playOnTransfer = true) {
   });
 }
 
-export function searchTracks(query) {
+// search returns normalized results per type plus a merged "top" list on
+// the first page. types defaults to track, album, artist and playlist.
+export function search(query, { types, offset, limit } = {}) {
   const params = new URLSearchParams({ q: query });
+  if (types?.length) params.set('type', types.join(','));
+  if (offset) params.set('offset', String(offset));
+  if (limit) params.set('limit', String(limit));
   return jsonRequest(`/api/search?${params.toString()}`);
 }
+
+function pageParams({ offset, limit } = {}) {
+  const params = new URLSearchParams();
+  if (offset) params.set('offset', String(offset));
+  if (limit) params.set('limit', String(limit));
+  const query = params.toString();
+  return query ? `?${query}` : '';
+}
+
+// getAlbum returns an album with a page of its tracks; each track's play
+// payload starts the album from that track.
+export function getAlbum(id, page) {
+  return jsonRequest(`/api/albums/${encodeURIComponent(id)}${pageParams(page)}`);
+}
+
+// getArtist returns an artist with top tracks, a page of albums and
+// singles, and related artists when Spotify provides them.
+export function getArtist(id, page) {
+  return jsonRequest(`/api/artists/${encodeURIComponent(id)}${pageParams(page)}`);
+}